@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/controller"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/weather"
+	"golang.org/x/term"
+)
+
+// runCommand run cli sub command, eg. bike export --from ... --to ...
+func runCommand(cfg *config.Config, store *models.PostgresStore, args []string) error {
+	switch args[0] {
+	case "export":
+		return runExport(store, args[1:])
+	case "weather-backfill":
+		return runWeatherBackfill(cfg, store, args[1:])
+	case "create-user":
+		return runCreateUser(cfg, store, args[1:])
+	case "create-api-key":
+		return runCreateAPIKey(cfg, store, args[1:])
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+func runExport(store *models.PostgresStore, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	from := fs.String("from", "", "export start time")
+	to := fs.String("to", "", "export end time")
+	format := fs.String("format", "csv", "csv, ndjson or parquet")
+	bikes := fs.Bool("bikes", false, "export bike rows instead of station rows")
+	out := fs.String("out", "", "output file path, default stdout")
+	fs.Parse(args)
+
+	f, t, err := controller.ParseTimeRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	file := os.Stdout
+	if *out != "" {
+		file, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+
+	ew, err := models.NewExportWriter(file, *format, *bikes)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = store.ExportStations(f, t, nil, *bikes, func(row models.ExportRow) error {
+		count++
+		return ew.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ew.Close(); err != nil {
+		return err
+	}
+
+	slog.Info("Exported rows", "rows", count)
+	return nil
+}
+
+func runWeatherBackfill(cfg *config.Config, store *models.PostgresStore, args []string) error {
+	fs := flag.NewFlagSet("weather-backfill", flag.ExitOnError)
+	from := fs.String("from", "", "backfill start time")
+	to := fs.String("to", "", "backfill end time")
+	fs.Parse(args)
+
+	f, t, err := controller.ParseTimeRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	provider, err := weather.NewHistoricalProvider(cfg.Weather)
+	if err != nil {
+		return err
+	}
+
+	// stop after current snapshot on ctrl+c, run again to resume
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := controller.NewAPIServer(cfg, store)
+	total, err := server.BackfillWeather(ctx, f, t, provider)
+	slog.Info("Weather backfill stored observations", "observations", total)
+	return err
+}
+
+func runCreateUser(cfg *config.Config, store *models.PostgresStore, args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ExitOnError)
+	username := fs.String("username", "", "login username")
+	role := fs.String("role", models.RoleViewer, "viewer, analyst, operator or admin")
+	fs.Parse(args)
+
+	// never a flag, it would be visible in ps and the shell history
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	server := controller.NewAPIServer(cfg, store)
+	u, err := server.CreateUser(context.Background(), *username, password, *role)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Created user", "role", u.Role, "username", u.Username, "id", u.Id)
+	return nil
+}
+
+// readPassword prompt on the terminal without echo, or read the first line of stdin when it is piped
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runCreateAPIKey(cfg *config.Config, store *models.PostgresStore, args []string) error {
+	fs := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	name := fs.String("name", "", "key name, eg. dashboard")
+	owner := fs.String("owner", "", "owner of the key")
+	role := fs.String("role", models.RoleViewer, "viewer, analyst, operator or admin")
+	scopes := fs.String("scopes", "", "optional comma separated scopes narrowing the role")
+	expires := fs.Duration("expires", 0, "key lifetime, eg. 720h, default never expire")
+	fs.Parse(args)
+
+	var expiresAt *time.Time
+	if *expires > 0 {
+		t := time.Now().Add(*expires)
+		expiresAt = &t
+	}
+
+	server := controller.NewAPIServer(cfg, store)
+	var scopeList []string
+	if *scopes != "" {
+		scopeList = strings.Split(*scopes, ",")
+	}
+
+	issued, err := server.IssueAPIKey(context.Background(), *name, *owner, *role, scopeList, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	server.RecordAudit(context.Background(), models.AuditEvent{
+		Actor:   "cli",
+		Action:  models.AuditKeyIssue,
+		Target:  fmt.Sprintf("api_key:%d", issued.Id),
+		Outcome: models.OutcomeSuccess,
+		Detail:  "role " + issued.Role,
+	})
+
+	slog.Info("Created api key, it is shown only once", "role", issued.Role, "id", issued.Id, "permissions", issued.Permissions())
+	fmt.Println(issued.Key)
+	return nil
+}
@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Config hold the settings of every component. Each field is read from the env name in its env tag,
+// and from the flag of the same name in lower case with dashes, eg. WEATHER_GRID_SIZE and --weather-grid-size.
+// Secret fields have no flag so they do not show in the process list.
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Database  Database  `yaml:"database"`
+	Auth      Auth      `yaml:"auth"`
+	OIDC      OIDC      `yaml:"oidc"`
+	JWT       JWT       `yaml:"jwt"`
+	RateLimit RateLimit `yaml:"rateLimit"`
+	Weather   Weather   `yaml:"weather"`
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+}
+
+type Server struct {
+	Addr           string   `yaml:"addr" env:"LISTEN_ADDR" usage:"http listen address"`
+	AllowedOrigins []string `yaml:"allowedOrigins" env:"ALLOWED_ORIGINS" usage:"comma separated frontend origins allowed by cors and websocket"`
+	IngestCron     string   `yaml:"ingestCron" env:"INGEST_CRON" usage:"cron spec of the indego ingest"`
+	TrustProxy     bool     `yaml:"trustProxy" env:"TRUST_PROXY" usage:"use the last X-Forwarded-For address as client ip, only behind one proxy appending it"`
+
+	// stream and export routes are exempt from read and write timeout
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"HTTP_READ_HEADER_TIMEOUT" usage:"deadline to read request headers"`
+	ReadTimeout       time.Duration `yaml:"readTimeout" env:"HTTP_READ_TIMEOUT" usage:"deadline to read the whole request"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" env:"HTTP_WRITE_TIMEOUT" usage:"deadline to write the response"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"HTTP_IDLE_TIMEOUT" usage:"keep-alive connection idle time"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" usage:"wait for in-flight requests and ingestion on shutdown"`
+
+	// readyz fail when the latest stored snapshot is older, 0 disable the check
+	ReadyMaxIngestAge time.Duration `yaml:"readyMaxIngestAge" env:"READY_MAX_INGEST_AGE" usage:"max age of the latest snapshot for readiness"`
+}
+
+// Database connect with URL when set, else with the separate fields
+type Database struct {
+	URL         string `yaml:"url" env:"DATABASE_URL" secret:"true"`
+	Host        string `yaml:"host" env:"DB_HOST" usage:"postgres host or unix socket directory"`
+	Port        int    `yaml:"port" env:"DB_PORT" usage:"postgres port"`
+	User        string `yaml:"user" env:"DB_USER" usage:"postgres user"`
+	Password    string `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name        string `yaml:"name" env:"DB_NAME" usage:"postgres database"`
+	SSLMode     string `yaml:"sslMode" env:"DB_SSLMODE" usage:"disable, require, verify-ca or verify-full"`
+	SSLRootCert string `yaml:"sslRootCert" env:"DB_SSLROOTCERT" usage:"ca certificate file to verify the server"`
+
+	// pool, 0 max open conns is unlimited
+	MaxOpenConns    int           `yaml:"maxOpenConns" env:"DB_MAX_OPEN_CONNS" usage:"max open connections"`
+	MaxIdleConns    int           `yaml:"maxIdleConns" env:"DB_MAX_IDLE_CONNS" usage:"max idle connections"`
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime" env:"DB_CONN_MAX_LIFETIME" usage:"close connections older than this"`
+	ConnMaxIdleTime time.Duration `yaml:"connMaxIdleTime" env:"DB_CONN_MAX_IDLE_TIME" usage:"close connections idle longer than this"`
+
+	ConnectTimeout time.Duration `yaml:"connectTimeout" env:"DB_CONNECT_TIMEOUT" usage:"deadline of one connection attempt"`
+	// keep retrying at startup until the database is reachable, 0 fail at the first attempt
+	ConnectRetry time.Duration `yaml:"connectRetry" env:"DB_CONNECT_RETRY" usage:"how long to wait for the database at startup"`
+}
+
+type Auth struct {
+	SessionTTL   time.Duration `yaml:"sessionTTL" env:"SESSION_TTL" usage:"login session lifetime"`
+	SecureCookie bool          `yaml:"secureCookie" env:"SESSION_COOKIE_SECURE" usage:"set Secure on the session cookie"`
+}
+
+// OIDC login is enabled when Domain and ClientId are set
+type OIDC struct {
+	Domain       string `yaml:"domain" env:"AUTH0_DOMAIN" usage:"auth0 tenant domain or issuer url"`
+	ClientId     string `yaml:"clientId" env:"AUTH0_CLIENT_ID" usage:"oidc client id"`
+	ClientSecret string `yaml:"clientSecret" env:"AUTH0_CLIENT_SECRET" secret:"true"`
+	CallbackUrl  string `yaml:"callbackUrl" env:"AUTH0_CALLBACK_URL" usage:"oidc redirect uri, eg. http://localhost:3000/api/v1/callback"`
+	RedirectUrl  string `yaml:"redirectUrl" env:"AUTH0_REDIRECT_URL" usage:"frontend url after login, default first allowed origin"`
+}
+
+// JWT bearer token is accepted when HS256Secret or JWKSUrl is set
+type JWT struct {
+	HS256Secret string `yaml:"hs256Secret" env:"JWT_HS256_SECRET" secret:"true"`
+	JWKSUrl     string `yaml:"jwksUrl" env:"JWT_JWKS_URL" usage:"jwks url of RS256 token issuer"`
+	Issuer      string `yaml:"issuer" env:"JWT_ISSUER" usage:"required token issuer"`
+	Audience    string `yaml:"audience" env:"JWT_AUDIENCE" usage:"required token audience"`
+	RolesClaim  string `yaml:"rolesClaim" env:"JWT_ROLES_CLAIM" usage:"claim holding the roles"`
+}
+
+// RateLimit hold route=rate/unit:burst lists, listed routes replace the defaults
+type RateLimit struct {
+	Store    string `yaml:"store" env:"RATE_LIMIT_STORE" usage:"memory or postgres (shared between instances)"`
+	Limits   string `yaml:"limits" env:"RATE_LIMITS" usage:"per credential limits, eg. default=120/m:60"`
+	IPLimits string `yaml:"ipLimits" env:"RATE_LIMITS_IP" usage:"per client ip limits"`
+}
+
+type Weather struct {
+	Provider        string `yaml:"provider" env:"WEATHER_PROVIDER" usage:"openweathermap, openmeteo or fixture"`
+	HistoryProvider string `yaml:"historyProvider" env:"WEATHER_HISTORY_PROVIDER" usage:"provider of weather-backfill, default provider"`
+	OpenWeatherKey  string `yaml:"openWeatherKey" env:"OPEN_WEATHER_APIKEY" secret:"true"`
+	FixtureFile     string `yaml:"fixtureFile" env:"WEATHER_FIXTURE_FILE" usage:"json report of the fixture provider"`
+	// 0.01 degree is around 1km, stations in same neighbourhood share one weather call
+	GridSize       float64       `yaml:"gridSize" env:"WEATHER_GRID_SIZE" usage:"weather cache cell size in degree"`
+	CacheTTL       time.Duration `yaml:"cacheTTL" env:"WEATHER_CACHE_TTL" usage:"weather cache lifetime"`
+	Parallelism    int           `yaml:"parallelism" env:"WEATHER_PARALLELISM" usage:"max concurrent weather calls per request or ingest"`
+	RequestTimeout time.Duration `yaml:"requestTimeout" env:"WEATHER_REQUEST_TIMEOUT" usage:"weather lookup deadline of one stations request"`
+}
+
+// Log use json lines by default, text is easier to read in a terminal
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" usage:"debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT" usage:"json or text"`
+}
+
+// Tracing export spans by OTLP over http when Endpoint is set
+type Tracing struct {
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" usage:"otlp http collector base url, eg. http://localhost:4318"`
+	ServiceName string  `yaml:"serviceName" env:"OTEL_SERVICE_NAME" usage:"service.name of the spans"`
+	SampleRatio float64 `yaml:"sampleRatio" env:"TRACE_SAMPLE_RATIO" usage:"ratio of new traces sampled, requests with a sampled parent are always sampled"`
+}
+
+const (
+	RateLimitMemory   = "memory"
+	RateLimitPostgres = "postgres"
+)
+
+var WeatherProviders = []string{"openweathermap", "openmeteo", "fixture"}
+
+var LogLevels = []string{"debug", "info", "warn", "error"}
+var LogFormats = []string{"json", "text"}
+
+// SSLModes are the modes supported by lib/pq
+var SSLModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// Default return the settings used when nothing is configured
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:           ":3000",
+			AllowedOrigins: []string{"http://localhost:5173"},
+			IngestCron:     "0 * * * *",
+
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			ReadyMaxIngestAge: 2 * time.Hour,
+		},
+		Database: Database{
+			Host:            "localhost",
+			Port:            5432,
+			SSLMode:         "disable",
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			ConnectTimeout:  5 * time.Second,
+			ConnectRetry:    time.Minute,
+		},
+		Auth: Auth{
+			SessionTTL:   24 * time.Hour,
+			SecureCookie: true,
+		},
+		JWT:       JWT{RolesClaim: "roles"},
+		RateLimit: RateLimit{Store: RateLimitMemory},
+		Weather: Weather{
+			Provider:       "openweathermap",
+			GridSize:       0.01,
+			CacheTTL:       10 * time.Minute,
+			Parallelism:    8,
+			RequestTimeout: 5 * time.Second,
+		},
+		Log:     Log{Level: "info", Format: "json"},
+		Tracing: Tracing{ServiceName: "bike", SampleRatio: 1},
+	}
+}
+
+// Validate return every invalid setting joined in one error
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "LISTEN_ADDR cannot be empty")
+	check(len(c.Server.AllowedOrigins) > 0, "ALLOWED_ORIGINS cannot be empty")
+	for _, origin := range c.Server.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(err == nil && u.Scheme != "" && u.Host != "", "ALLOWED_ORIGINS %v must be scheme://host", origin)
+	}
+	_, err := cron.ParseStandard(c.Server.IngestCron)
+	check(err == nil, "INGEST_CRON %v is not a valid cron spec", c.Server.IngestCron)
+	check(c.Server.ReadHeaderTimeout > 0 && c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 && c.Server.IdleTimeout > 0,
+		"HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT must be positive")
+	check(c.Server.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.Server.ReadyMaxIngestAge >= 0, "READY_MAX_INGEST_AGE cannot be negative")
+
+	if c.Database.URL != "" {
+		u, err := url.Parse(c.Database.URL)
+		check(err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql"), "DATABASE_URL must be a postgres:// url")
+	}
+	check(c.Database.Port > 0 && c.Database.Port < 65536, "DB_PORT must be between 1 and 65535")
+	check(slices.Contains(SSLModes, c.Database.SSLMode), "DB_SSLMODE must be one of %v", SSLModes)
+	check(c.Database.MaxOpenConns >= 0 && c.Database.MaxIdleConns >= 0, "DB_MAX_OPEN_CONNS and DB_MAX_IDLE_CONNS cannot be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "DB_MAX_IDLE_CONNS cannot be over DB_MAX_OPEN_CONNS")
+	check(c.Database.ConnMaxLifetime >= 0 && c.Database.ConnMaxIdleTime >= 0, "DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME cannot be negative")
+	check(c.Database.ConnectTimeout > 0, "DB_CONNECT_TIMEOUT must be positive")
+	check(c.Database.ConnectRetry >= 0, "DB_CONNECT_RETRY cannot be negative")
+
+	check(c.Auth.SessionTTL > 0, "SESSION_TTL must be positive")
+
+	if c.OIDC.Domain != "" || c.OIDC.ClientId != "" {
+		check(c.OIDC.Domain != "" && c.OIDC.ClientId != "", "AUTH0_DOMAIN and AUTH0_CLIENT_ID must be set together")
+		check(c.OIDC.CallbackUrl != "", "AUTH0_CALLBACK_URL is required for oidc login")
+	}
+
+	check(c.JWT.RolesClaim != "", "JWT_ROLES_CLAIM cannot be empty")
+	check(slices.Contains([]string{RateLimitMemory, RateLimitPostgres}, c.RateLimit.Store), "RATE_LIMIT_STORE must be memory or postgres")
+
+	check(slices.Contains(WeatherProviders, c.Weather.Provider), "WEATHER_PROVIDER must be one of %v", WeatherProviders)
+	check(c.Weather.HistoryProvider == "" || slices.Contains(WeatherProviders, c.Weather.HistoryProvider), "WEATHER_HISTORY_PROVIDER must be one of %v", WeatherProviders)
+	check(c.Weather.GridSize > 0, "WEATHER_GRID_SIZE must be positive")
+	check(c.Weather.CacheTTL > 0, "WEATHER_CACHE_TTL must be positive")
+	check(c.Weather.Parallelism > 0, "WEATHER_PARALLELISM must be positive")
+	check(c.Weather.RequestTimeout > 0, "WEATHER_REQUEST_TIMEOUT must be positive")
+
+	check(slices.Contains(LogLevels, c.Log.Level), "LOG_LEVEL must be one of %v", LogLevels)
+	check(slices.Contains(LogFormats, c.Log.Format), "LOG_FORMAT must be one of %v", LogFormats)
+
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "OTEL_EXPORTER_OTLP_ENDPOINT must be an http(s) url")
+	}
+	check(c.Tracing.ServiceName != "", "OTEL_SERVICE_NAME cannot be empty")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "TRACE_SAMPLE_RATIO must be between 0 and 1")
+
+	return errors.Join(errs...)
+}
+
+// DSN return DATABASE_URL as is, else a lib/pq key=value connection string of the set fields
+func (d Database) DSN() string {
+	if d.URL != "" {
+		return d.URL
+	}
+
+	params := []string{}
+	add := func(key string, v string) {
+		if v == "" {
+			return
+		}
+		v = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+		params = append(params, fmt.Sprintf("%v='%v'", key, v))
+	}
+
+	add("host", d.Host)
+	add("port", strconv.Itoa(d.Port))
+	add("user", d.User)
+	add("password", d.Password)
+	add("dbname", d.Name)
+	add("sslmode", d.SSLMode)
+	add("sslrootcert", d.SSLRootCert)
+	if d.ConnectTimeout >= time.Second {
+		add("connect_timeout", strconv.Itoa(int(d.ConnectTimeout.Seconds())))
+	}
+	return strings.Join(params, " ")
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bike.yaml")
+	file := `
+server:
+  addr: ":4000"
+  allowedOrigins: ["https://bike.example.com"]
+weather:
+  provider: openmeteo
+  gridSize: 0.05
+  cacheTTL: 30m
+`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("WEATHER_GRID_SIZE", "0.02")
+	t.Setenv("LISTEN_ADDR", ":5000")
+	t.Setenv("DB_PASSWORD", "secret")
+
+	c, args, err := Load([]string{"--config", path, "--listen-addr", ":6000", "export", "--format", "csv"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"export", "--format", "csv"}, args)
+
+	// flag over env over file over default
+	assert.Equal(t, ":6000", c.Server.Addr)
+	assert.Equal(t, 0.02, c.Weather.GridSize)
+	assert.Equal(t, 30*time.Minute, c.Weather.CacheTTL)
+	assert.Equal(t, "openmeteo", c.Weather.Provider)
+	assert.Equal(t, []string{"https://bike.example.com"}, c.Server.AllowedOrigins)
+	assert.Equal(t, 8, c.Weather.Parallelism)
+	assert.Equal(t, "secret", c.Database.Password)
+
+	// secrets have no flag
+	_, _, err = Load([]string{"--db-password", "secret"})
+	assert.NotNil(t, err)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Setenv("WEATHER_PARALLELISM", "many")
+	_, _, err := Load(nil)
+	assert.ErrorContains(t, err, "WEATHER_PARALLELISM")
+
+	path := filepath.Join(t.TempDir(), "bike.yaml")
+	if err := os.WriteFile(path, []byte("weather:\n  gridsize: 0.05\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = Load([]string{"--config", path})
+	assert.ErrorContains(t, err, "gridsize")
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	assert.Nil(t, c.Validate())
+
+	c.Server.IngestCron = "every hour"
+	c.RateLimit.Store = "redis"
+	c.OIDC.Domain = "tenant.auth0.com"
+	c.Weather.Provider = "darksky"
+	c.Log.Level = "verbose"
+	c.Tracing.Endpoint = "localhost:4318"
+	err := c.Validate()
+	assert.ErrorContains(t, err, "INGEST_CRON")
+	assert.ErrorContains(t, err, "RATE_LIMIT_STORE")
+	assert.ErrorContains(t, err, "AUTH0_CLIENT_ID")
+	assert.ErrorContains(t, err, "WEATHER_PROVIDER")
+	assert.ErrorContains(t, err, "LOG_LEVEL")
+	assert.ErrorContains(t, err, "OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+func TestDatabaseDSN(t *testing.T) {
+	d := Default().Database
+	d.Host = "db.example.com"
+	d.User = "bike"
+	d.Password = `it's \secret`
+	d.Name = "bike"
+	d.SSLMode = "verify-full"
+	d.SSLRootCert = "/etc/ssl/rds.pem"
+	assert.Equal(t, `host='db.example.com' port='5432' user='bike' password='it\'s \\secret' dbname='bike' sslmode='verify-full' sslrootcert='/etc/ssl/rds.pem' connect_timeout='5'`, d.DSN())
+
+	d.URL = "postgres://bike:pw@db.example.com:6432/bike?sslmode=require"
+	assert.Equal(t, d.URL, d.DSN())
+
+	c := Default()
+	c.Database.URL = "mysql://db"
+	c.Database.SSLMode = "prefer"
+	c.Database.MaxOpenConns = 2
+	err := c.Validate()
+	assert.ErrorContains(t, err, "DATABASE_URL")
+	assert.ErrorContains(t, err, "DB_SSLMODE")
+	assert.ErrorContains(t, err, "DB_MAX_IDLE_CONNS")
+}
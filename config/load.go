@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// field is a setting with an env tag
+type field struct {
+	env    string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+func fields(c *Config) []field {
+	var out []field
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Duration(0)) {
+				walk(v.Field(i))
+				continue
+			}
+			if env := f.Tag.Get("env"); env != "" {
+				out = append(out, field{env: env, usage: f.Tag.Get("usage"), secret: f.Tag.Get("secret") == "true", value: v.Field(i)})
+			}
+		}
+	}
+	walk(reflect.ValueOf(c).Elem())
+	return out
+}
+
+// flagName turn WEATHER_GRID_SIZE into weather-grid-size
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// set parse the string value into the field, list is comma separated
+func (f field) set(s string) error {
+	var err error
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		f.value.SetBool(b)
+	case int:
+		var n int
+		n, err = strconv.Atoi(s)
+		f.value.SetInt(int64(n))
+	case float64:
+		var n float64
+		n, err = strconv.ParseFloat(s, 64)
+		f.value.SetFloat(n)
+	case time.Duration:
+		var d time.Duration
+		d, err = time.ParseDuration(s)
+		f.value.SetInt(int64(d))
+	case []string:
+		list := []string{}
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("%v has unsupported type %v", f.env, f.value.Type())
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %v %q: %v", f.env, s, err)
+	}
+	return nil
+}
+
+func (f field) String() string {
+	if list, ok := f.value.Interface().([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// Load read the defaults, then the yaml file of --config or CONFIG_FILE, then env, then flags.
+// It return the arguments after the flags, eg. the cli sub command.
+func Load(args []string) (*Config, []string, error) {
+	c := Default()
+	fs := flag.NewFlagSet("bike", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "yaml config file")
+
+	// flags are applied after file and env, so only remember the raw values here
+	set := map[string]string{}
+	all := fields(c)
+	for _, f := range all {
+		if f.secret {
+			continue
+		}
+		name := flagName(f.env)
+		fs.Func(name, f.usage+" ("+f.env+", default "+f.String()+")", func(s string) error {
+			set[name] = s
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		// empty file keep the defaults
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("invalid config file %v: %v", *path, err)
+		}
+	}
+
+	for _, f := range all {
+		if v, ok := os.LookupEnv(f.env); ok && v != "" {
+			if err := f.set(v); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	for _, f := range all {
+		if v, ok := set[flagName(f.env)]; ok {
+			if err := f.set(v); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
@@ -0,0 +1,386 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// attempts in total, the first try included
+	alertMaxAttempts = 3
+	alertRetryDelay  = 2 * time.Second
+)
+
+// alertClient is used for webhook delivery
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+type AlertPayload struct {
+	RuleId            int64  `json:"ruleId"`
+	RuleName          string `json:"ruleName"`
+	Condition         string `json:"condition"`
+	KioskId           int64  `json:"kioskId"`
+	StationName       string `json:"stationName"`
+	BikesAvailable    int64  `json:"bikesAvailable"`
+	DocksAvailable    int64  `json:"docksAvailable"`
+	KioskPublicStatus string `json:"kioskPublicStatus"`
+	Since             string `json:"since"`
+	At                string `json:"at"`
+}
+
+func validateAlertRule(a models.AlertRule) error {
+	switch a.Condition {
+	case models.AlertBikesBelow, models.AlertDocksBelow:
+		if a.Threshold < 1 {
+			return fmt.Errorf("threshold must be greater than 0")
+		}
+	case models.AlertStatusIs:
+		if a.Status == "" {
+			return fmt.Errorf("status cannot be empty")
+		}
+	default:
+		return fmt.Errorf("condition must be one of %v, %v, %v", models.AlertBikesBelow, models.AlertDocksBelow, models.AlertStatusIs)
+	}
+
+	if a.DurationMinutes < 0 {
+		return fmt.Errorf("durationMinutes cannot be negative")
+	}
+
+	u, err := url.Parse(a.WebhookUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhookUrl")
+	}
+
+	return nil
+}
+
+func alertConditionMet(a models.AlertRule, p models.Properties) bool {
+	switch a.Condition {
+	case models.AlertBikesBelow:
+		return p.BikesAvailable < a.Threshold
+	case models.AlertDocksBelow:
+		return p.DocksAvailable < a.Threshold
+	case models.AlertStatusIs:
+		return strings.EqualFold(p.KioskPublicStatus, a.Status)
+	}
+	return false
+}
+
+// signPayload return hex hmac sha256 of body, receiver verify X-Bike-Signature with the rule secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// EvaluateAlerts check every active rule against the new snapshot, run after each ingest
+func (s *APIServer) EvaluateAlerts(ctx context.Context, snap Snapshot) {
+	ctx, span := tracing.Start(ctx, "alerts.evaluate", trace.WithAttributes(attribute.String("snapshot.at", snap.At)))
+	defer span.End()
+
+	at, err := time.Parse("2006-01-02 15:04:05", snap.At)
+	if err != nil {
+		slog.ErrorContext(ctx, "Alert evaluate invalid snapshot time", "at", snap.At, "err", err)
+		return
+	}
+
+	rules, err := s.db(ctx).GetAlertRules(models.Page{})
+	if err != nil {
+		slog.ErrorContext(ctx, "Alert evaluate get rules error", "err", err)
+		return
+	}
+
+	for _, rule := range rules {
+		if !rule.Active {
+			continue
+		}
+
+		states, err := s.db(ctx).GetAlertStates(rule.Id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Alert evaluate get states error", "rule", rule.Id, "err", err)
+			continue
+		}
+
+		for _, f := range snap.Features {
+			p := f.Properties
+			if rule.KioskId != nil && *rule.KioskId != p.KioskId {
+				continue
+			}
+
+			st, tracking := states[p.KioskId]
+			if !alertConditionMet(rule, p) {
+				if tracking {
+					if err := s.db(ctx).DeleteAlertState(rule.Id, p.KioskId); err != nil {
+						slog.ErrorContext(ctx, "Alert delete state error", "rule", rule.Id, "err", err)
+					}
+				}
+				continue
+			}
+
+			if !tracking {
+				st = models.AlertState{RuleId: rule.Id, KioskId: p.KioskId, Since: at}
+			}
+
+			notify := !st.Notified && at.Sub(st.Since) >= time.Duration(rule.DurationMinutes)*time.Minute
+			if notify {
+				st.Notified = true
+			}
+
+			if !tracking || notify {
+				if err := s.db(ctx).SaveAlertState(st); err != nil {
+					slog.ErrorContext(ctx, "Alert save state error", "rule", rule.Id, "err", err)
+					continue
+				}
+			}
+
+			if notify {
+				payload := AlertPayload{
+					RuleId:            rule.Id,
+					RuleName:          rule.Name,
+					Condition:         rule.Condition,
+					KioskId:           p.KioskId,
+					StationName:       p.Name,
+					BikesAvailable:    p.BikesAvailable,
+					DocksAvailable:    p.DocksAvailable,
+					KioskPublicStatus: p.KioskPublicStatus,
+					Since:             st.Since.Format("2006-01-02 15:04:05"),
+					At:                snap.At,
+				}
+				s.background(func() { s.deliverAlert(ctx, rule, payload) })
+			}
+		}
+	}
+}
+
+func (s *APIServer) deliverAlert(ctx context.Context, rule models.AlertRule, payload AlertPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "Alert payload marshal error", "rule", rule.Id, "err", err)
+		return
+	}
+
+	d := models.AlertDelivery{RuleId: rule.Id, KioskId: payload.KioskId, Payload: string(body), Status: "pending"}
+	if err := s.db(ctx).CreateAlertDelivery(&d); err != nil {
+		return
+	}
+
+	signature := signPayload(rule.Secret, body)
+	for d.Attempts < alertMaxAttempts {
+		if d.Attempts > 0 {
+			time.Sleep(alertRetryDelay * time.Duration(1<<(d.Attempts-1)))
+		}
+		d.Attempts++
+
+		code, err := postWebhook(rule.WebhookUrl, d.Id, signature, body)
+		if code != 0 {
+			c := int64(code)
+			d.ResponseCode = &c
+		}
+		if err == nil {
+			now := time.Now()
+			d.Status = "delivered"
+			d.DeliveredAt = &now
+			d.LastError = nil
+			break
+		}
+
+		errMsg := err.Error()
+		d.Status = "failed"
+		d.LastError = &errMsg
+		slog.WarnContext(ctx, "Alert webhook delivery error", "rule", rule.Id, "delivery", d.Id, "attempt", d.Attempts, "err", err)
+	}
+
+	if err := s.db(ctx).UpdateAlertDelivery(&d); err != nil {
+		slog.ErrorContext(ctx, "Alert delivery update error", "delivery", d.Id, "err", err)
+	}
+}
+
+func postWebhook(webhookUrl string, deliveryId int64, signature string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bike-Delivery", strconv.FormatInt(deliveryId, 10))
+	req.Header.Set("X-Bike-Signature", "sha256="+signature)
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func alertRuleId(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid alert id")
+	}
+	return id, nil
+}
+
+func alertNotFound(w http.ResponseWriter, err error) error {
+	if strings.Contains(err.Error(), "empty row") {
+		status := http.StatusNotFound
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Alert not found"})
+	}
+	status := http.StatusBadRequest
+	return ResponseJSON(w, status, APIResponse{Status: status, Message: err.Error()})
+}
+
+func (s *APIServer) GetAlerts(w http.ResponseWriter, r *http.Request) error {
+	page, _, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+
+	rules, next, err := fetchPage(r, "", page, s.db(r.Context()).GetAlertRules, func(a models.AlertRule) int64 { return a.Id })
+	if err != nil {
+		return err
+	}
+
+	for i := range rules {
+		rules[i].Secret = ""
+	}
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: rules, Next: next})
+}
+
+func (s *APIServer) GetAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := alertRuleId(r)
+	if err != nil {
+		return err
+	}
+
+	rule, err := s.db(r.Context()).GetAlertRule(id)
+	if err != nil {
+		return alertNotFound(w, err)
+	}
+
+	rule.Secret = ""
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: rule})
+}
+
+// CreateAlert return the generated secret only once, it is used to verify webhook signature
+func (s *APIServer) CreateAlert(w http.ResponseWriter, r *http.Request) error {
+	rule := models.AlertRule{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return fmt.Errorf("invalid request body")
+	}
+
+	if err := validateAlertRule(rule); err != nil {
+		return err
+	}
+
+	if rule.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			return err
+		}
+		rule.Secret = secret
+	}
+
+	if err := s.db(r.Context()).CreateAlertRule(&rule); err != nil {
+		s.audit(r, "", models.AuditAlertCreate, rule.Name, models.OutcomeFailure, err.Error())
+		return err
+	}
+	s.audit(r, "", models.AuditAlertCreate, fmt.Sprintf("alert:%d", rule.Id), models.OutcomeSuccess, rule.Name)
+
+	return ResponseJSON(w, http.StatusCreated, APIResponse{Status: http.StatusCreated, Message: "Success", Data: rule})
+}
+
+func (s *APIServer) UpdateAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := alertRuleId(r)
+	if err != nil {
+		return err
+	}
+
+	rule, err := s.db(r.Context()).GetAlertRule(id)
+	if err != nil {
+		return alertNotFound(w, err)
+	}
+
+	// secret cannot be changed by update
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return fmt.Errorf("invalid request body")
+	}
+	rule.Id = id
+
+	if err := validateAlertRule(rule); err != nil {
+		return err
+	}
+
+	if err := s.db(r.Context()).UpdateAlertRule(&rule); err != nil {
+		s.audit(r, "", models.AuditAlertUpdate, fmt.Sprintf("alert:%d", id), models.OutcomeFailure, err.Error())
+		return alertNotFound(w, err)
+	}
+	s.audit(r, "", models.AuditAlertUpdate, fmt.Sprintf("alert:%d", id), models.OutcomeSuccess, rule.Name)
+
+	rule.Secret = ""
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: rule})
+}
+
+func (s *APIServer) DeleteAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := alertRuleId(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db(r.Context()).DeleteAlertRule(id); err != nil {
+		s.audit(r, "", models.AuditAlertDelete, fmt.Sprintf("alert:%d", id), models.OutcomeFailure, err.Error())
+		return alertNotFound(w, err)
+	}
+	s.audit(r, "", models.AuditAlertDelete, fmt.Sprintf("alert:%d", id), models.OutcomeSuccess, "")
+
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success"})
+}
+
+func (s *APIServer) GetAlertDeliveries(w http.ResponseWriter, r *http.Request) error {
+	id, err := alertRuleId(r)
+	if err != nil {
+		return err
+	}
+
+	page, _, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+
+	deliveries, next, err := fetchPage(r, "", page, func(page models.Page) ([]models.AlertDelivery, error) {
+		return s.db(r.Context()).GetAlertDeliveries(id, page)
+	}, func(d models.AlertDelivery) int64 { return d.Id })
+	if err != nil {
+		return err
+	}
+
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: deliveries, Next: next})
+}
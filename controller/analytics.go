@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/utils"
+)
+
+// temperature bucket width in celsius
+const temperatureBand = 5
+
+type ImpactBucket struct {
+	Bucket            string  `json:"bucket"`
+	Samples           int64   `json:"samples"`
+	AvgBikesAvailable float64 `json:"avgBikesAvailable"`
+	AvgDocksAvailable float64 `json:"avgDocksAvailable"`
+	// AvgTurnover is the average absolute change of bikes available since the previous snapshot of the same station
+	AvgTurnover float64 `json:"avgTurnover"`
+
+	order           float64
+	bikes           int64
+	docks           int64
+	turnover        int64
+	turnoverSamples int64
+}
+
+type WeatherImpact struct {
+	From            string          `json:"from"`
+	To              string          `json:"to"`
+	KioskId         *int64          `json:"kioskId"`
+	Samples         int64           `json:"samples"`
+	Unmatched       int64           `json:"unmatched"`
+	ByTemperature   []*ImpactBucket `json:"byTemperature"`
+	ByCondition     []*ImpactBucket `json:"byCondition"`
+	ByPrecipitation []*ImpactBucket `json:"byPrecipitation"`
+	ByWind          []*ImpactBucket `json:"byWind"`
+}
+
+// impactAggregator accumulate station samples into buckets without keeping the samples
+type impactAggregator struct {
+	temperature   map[string]*ImpactBucket
+	condition     map[string]*ImpactBucket
+	precipitation map[string]*ImpactBucket
+	wind          map[string]*ImpactBucket
+	lastBikes     map[int64]int64
+	samples       int64
+	unmatched     int64
+}
+
+func newImpactAggregator() *impactAggregator {
+	return &impactAggregator{
+		temperature:   make(map[string]*ImpactBucket),
+		condition:     make(map[string]*ImpactBucket),
+		precipitation: make(map[string]*ImpactBucket),
+		wind:          make(map[string]*ImpactBucket),
+		lastBikes:     make(map[int64]int64),
+	}
+}
+
+// bucket functions return the bucket name and its sort order
+
+func temperatureBucket(temp float64) (string, float64) {
+	low := int64(math.Floor(temp/temperatureBand)) * temperatureBand
+	return fmt.Sprintf("%d to %d", low, low+temperatureBand), float64(low)
+}
+
+// precipitationBucket use mm per hour rain intensity
+func precipitationBucket(mm float64) (string, float64) {
+	switch {
+	case mm <= 0:
+		return "none", 0
+	case mm < 2.5:
+		return "light", 1
+	case mm < 7.6:
+		return "moderate", 2
+	}
+	return "heavy", 3
+}
+
+// windBucket use m/s wind speed
+func windBucket(speed float64) (string, float64) {
+	switch {
+	case speed < 3:
+		return "calm", 0
+	case speed < 8:
+		return "moderate", 1
+	}
+	return "strong", 2
+}
+
+func addToBucket(buckets map[string]*ImpactBucket, key string, order float64, bikes int64, docks int64, turnover int64, hasTurnover bool) {
+	b, ok := buckets[key]
+	if !ok {
+		b = &ImpactBucket{Bucket: key, order: order}
+		buckets[key] = b
+	}
+
+	b.Samples++
+	b.bikes += bikes
+	b.docks += docks
+	if hasTurnover {
+		b.turnover += turnover
+		b.turnoverSamples++
+	}
+}
+
+// add expect samples ordered by snapshot time so turnover compare with the previous snapshot
+func (a *impactAggregator) add(kioskId int64, bikes int64, docks int64, w *models.WeatherReport) {
+	last, hasTurnover := a.lastBikes[kioskId]
+	a.lastBikes[kioskId] = bikes
+	if w == nil {
+		a.unmatched++
+		return
+	}
+
+	turnover := bikes - last
+	if turnover < 0 {
+		turnover = -turnover
+	}
+
+	a.samples++
+	key, order := temperatureBucket(w.Temp)
+	addToBucket(a.temperature, key, order, bikes, docks, turnover, hasTurnover)
+	addToBucket(a.condition, w.Condition, 0, bikes, docks, turnover, hasTurnover)
+	key, order = precipitationBucket(w.Precipitation)
+	addToBucket(a.precipitation, key, order, bikes, docks, turnover, hasTurnover)
+	key, order = windBucket(w.WindSpeed)
+	addToBucket(a.wind, key, order, bikes, docks, turnover, hasTurnover)
+}
+
+func sortedBuckets(buckets map[string]*ImpactBucket) []*ImpactBucket {
+	res := []*ImpactBucket{}
+	for _, b := range buckets {
+		b.AvgBikesAvailable = float64(b.bikes) / float64(b.Samples)
+		b.AvgDocksAvailable = float64(b.docks) / float64(b.Samples)
+		if b.turnoverSamples > 0 {
+			b.AvgTurnover = float64(b.turnover) / float64(b.turnoverSamples)
+		}
+		res = append(res, b)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].order != res[j].order {
+			return res[i].order < res[j].order
+		}
+		return res[i].Bucket < res[j].Bucket
+	})
+	return res
+}
+
+func (a *impactAggregator) result() WeatherImpact {
+	return WeatherImpact{
+		Samples:         a.samples,
+		Unmatched:       a.unmatched,
+		ByTemperature:   sortedBuckets(a.temperature),
+		ByCondition:     sortedBuckets(a.condition),
+		ByPrecipitation: sortedBuckets(a.precipitation),
+		ByWind:          sortedBuckets(a.wind),
+	}
+}
+
+func (s *APIServer) GetWeatherImpact(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	q := r.URL.Query()
+	from, to, err := ParseTimeRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: err.Error()})
+	}
+
+	var kioskId *int64
+	if k := q.Get("kioskId"); k != "" {
+		id, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			status := http.StatusBadRequest
+			return ResponseJSON(w, status, APIResponse{Status: status, Message: "Invalid kioskId"})
+		}
+		kioskId = &id
+	}
+
+	observations, err := s.db(r.Context()).GetWeatherObservations(from, to)
+	if err != nil {
+		return err
+	}
+
+	// snapshot time + cell to weather
+	weatherOf := make(map[string]*models.WeatherReport, len(observations))
+	for i, o := range observations {
+		weatherOf[o.SnapshotAt+"|"+o.Cell] = &observations[i].Report
+	}
+
+	agg := newImpactAggregator()
+	err = s.db(r.Context()).ExportStations(from, to, kioskId, false, func(row models.ExportRow) error {
+		st := row.(models.ExportStation)
+		t, err := utils.ParseTime(st.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		key, _, _ := s.weather.cell(st.Latitude, st.Longitude)
+		agg.add(st.KioskId, st.BikesAvailable, st.DocksAvailable, weatherOf[t.Format("2006-01-02 15:04:05")+"|"+key])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	res := agg.result()
+	res.From = from
+	res.To = to
+	res.KioskId = kioskId
+	slog.InfoContext(r.Context(), "Computed weather impact", "samples", res.Samples, "duration", time.Since(now))
+
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: res})
+}
@@ -1,11 +1,14 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,14 +16,41 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/robfig/cron/v3"
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/metrics"
 	"github.com/waiwen1001/bike/middleware"
 	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
 	"github.com/waiwen1001/bike/utils"
+	"github.com/waiwen1001/bike/weather"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type APIServer struct {
-	listenAddr string
-	store      models.Storage
+	listenAddr      string
+	allowedOrigins  []string
+	ingestCron      string
+	serverConfig    config.Server
+	store           models.Storage
+	hub             *Hub
+	weather         *WeatherCache
+	weatherProvider weather.Provider
+	weatherParallel int
+	weatherTimeout  time.Duration
+	sessionTTL      time.Duration
+	secureCookie    bool
+	oidc            *OIDCAuth
+	jwt             *middleware.JWTAuth
+	limiter         *middleware.RateLimiter
+	sharedLimit     bool
+	trustProxy      bool
+
+	// closed on shutdown to end stream connections
+	shutdown chan struct{}
+	// alert delivery and weather capture started by ingest
+	tasks sync.WaitGroup
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
@@ -29,9 +59,15 @@ type APIResponse struct {
 	Status  int
 	Message string
 	Data    any
+	Next    string `json:",omitempty"`
 }
 
-var cache sync.Map
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+const indegoUrl = "https://bts-status.bicycletransit.workers.dev/phl"
 
 func ResponseJSON(w http.ResponseWriter, status int, v any) error {
 	w.Header().Add("Content-Type", "application/json")
@@ -48,54 +84,231 @@ func makeHttpHandleFunc(f apiFunc) http.HandlerFunc {
 	}
 }
 
-func NewAPIServer(listenAddr string, store models.Storage) *APIServer {
+func NewAPIServer(cfg *config.Config, store models.Storage) *APIServer {
+	provider, err := weather.NewProvider(cfg.Weather.Provider, cfg.Weather)
+	if err != nil {
+		slog.Error("Error loading weather provider", "err", err)
+		os.Exit(1)
+	}
+
+	// postgres store share buckets between instances
+	var limitStore middleware.RateLimitStore = middleware.NewMemoryRateLimitStore()
+	sharedLimit := cfg.RateLimit.Store == config.RateLimitPostgres
+	if sharedLimit {
+		limitStore = store
+	}
+
+	limiter, err := middleware.NewRateLimiterFromConfig(limitStore, cfg.RateLimit, cfg.Server.TrustProxy)
+	if err != nil {
+		slog.Error("Error loading rate limit config", "err", err)
+		os.Exit(1)
+	}
+
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:      cfg.Server.Addr,
+		allowedOrigins:  cfg.Server.AllowedOrigins,
+		ingestCron:      cfg.Server.IngestCron,
+		serverConfig:    cfg.Server,
+		shutdown:        make(chan struct{}),
+		store:           store,
+		hub:             NewHub(),
+		weather:         NewWeatherCache(cfg.Weather.GridSize, cfg.Weather.CacheTTL),
+		weatherProvider: provider,
+		weatherParallel: cfg.Weather.Parallelism,
+		weatherTimeout:  cfg.Weather.RequestTimeout,
+		sessionTTL:      cfg.Auth.SessionTTL,
+		secureCookie:    cfg.Auth.SecureCookie,
+		oidc:            NewOIDCAuthFromConfig(cfg.OIDC, cfg.Server.AllowedOrigins[0]),
+		jwt:             middleware.NewJWTAuthFromConfig(cfg.JWT),
+		limiter:         limiter,
+		sharedLimit:     sharedLimit,
+		trustProxy:      cfg.Server.TrustProxy,
 	}
 }
 
-func (s *APIServer) Run() {
+// Handler return the api routes wrapped with CORS
+func (s *APIServer) Handler() http.Handler {
 	router := mux.NewRouter()
 
+	// probes of the load balancer, no credential required
+	router.HandleFunc("/healthz", makeHttpHandleFunc(s.Healthz)).Methods("GET")
+	router.HandleFunc("/readyz", makeHttpHandleFunc(s.Readyz)).Methods("GET")
+	router.HandleFunc("/version", makeHttpHandleFunc(s.Version)).Methods("GET")
+	// prometheus scrape, restrict it to the internal network at the load balancer
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+
 	apiRouter := router.PathPrefix("/api/v1").Subrouter()
 	// for login
 	apiRouter.HandleFunc("/check-auth", makeHttpHandleFunc(s.CheckAuth)).Methods("GET")
 	apiRouter.HandleFunc("/login", makeHttpHandleFunc(s.Login)).Methods("POST")
+	// oidc authorization code flow
+	apiRouter.HandleFunc("/login", makeHttpHandleFunc(s.OIDCLogin)).Methods("GET")
+	apiRouter.HandleFunc("/callback", makeHttpHandleFunc(s.OIDCCallback)).Methods("GET")
 	apiRouter.HandleFunc("/logout", makeHttpHandleFunc(s.Logout)).Methods("POST")
 
-	protectedRouter := apiRouter.NewRoute().Subrouter()
-	protectedRouter.Use(middleware.TokenAuthMiddleware)
+	// each subrouter require api key in Token header, bearer token or login session granted the permission
+	keys := middleware.NewAuth(s.store, s.jwt).OnReject(s.auditReject)
+	scoped := func(scope string) *mux.Router {
+		r := apiRouter.NewRoute().Subrouter()
+		r.Use(keys.Require(scope))
+		return r
+	}
+
+	ingestRouter := scoped(models.ScopeIngestWrite)
+	ingestRouter.HandleFunc("/indego-data-fetch-and-store-it-db", makeHttpHandleFunc(s.FetchIndegoData)).Methods("POST")
+
+	stationsRouter := scoped(models.ScopeStationsRead)
+	stationsRouter.HandleFunc("/stations", makeHttpHandleFunc(s.GetStations)).Methods("GET")
+	stationsRouter.HandleFunc("/stations/{kioskId}", makeHttpHandleFunc(s.GetStation)).Methods("GET")
+	stationsRouter.HandleFunc("/export", makeHttpHandleFunc(s.Export)).Methods("GET")
+	stationsRouter.HandleFunc("/stream", makeHttpHandleFunc(s.Stream)).Methods("GET")
+	stationsRouter.HandleFunc("/ws", makeHttpHandleFunc(s.StreamWebSocket)).Methods("GET")
+
+	analyticsRouter := scoped(models.ScopeAnalyticsRead)
+	analyticsRouter.HandleFunc("/analytics/weather-impact", makeHttpHandleFunc(s.GetWeatherImpact)).Methods("GET")
+
+	alertsReadRouter := scoped(models.ScopeAlertsRead)
+	alertsReadRouter.HandleFunc("/alerts", makeHttpHandleFunc(s.GetAlerts)).Methods("GET")
+	alertsReadRouter.HandleFunc("/alerts/{id}", makeHttpHandleFunc(s.GetAlert)).Methods("GET")
+	alertsReadRouter.HandleFunc("/alerts/{id}/deliveries", makeHttpHandleFunc(s.GetAlertDeliveries)).Methods("GET")
 
-	protectedRouter.HandleFunc("/indego-data-fetch-and-store-it-db", makeHttpHandleFunc(s.FetchIndegoData)).Methods("POST")
-	protectedRouter.HandleFunc("/stations", makeHttpHandleFunc(s.GetStations)).Methods("GET")
-	protectedRouter.HandleFunc("/stations/{kioskId}", makeHttpHandleFunc(s.GetStation)).Methods("GET")
+	alertsWriteRouter := scoped(models.ScopeAlertsWrite)
+	alertsWriteRouter.HandleFunc("/alerts", makeHttpHandleFunc(s.CreateAlert)).Methods("POST")
+	alertsWriteRouter.HandleFunc("/alerts/{id}", makeHttpHandleFunc(s.UpdateAlert)).Methods("PUT")
+	alertsWriteRouter.HandleFunc("/alerts/{id}", makeHttpHandleFunc(s.DeleteAlert)).Methods("DELETE")
+
+	keysRouter := scoped(models.ScopeKeysManage)
+	keysRouter.HandleFunc("/api-keys", makeHttpHandleFunc(s.GetAPIKeys)).Methods("GET")
+	keysRouter.HandleFunc("/api-keys", makeHttpHandleFunc(s.CreateAPIKey)).Methods("POST")
+	keysRouter.HandleFunc("/api-keys/{id}", makeHttpHandleFunc(s.RevokeAPIKey)).Methods("DELETE")
+
+	deleteRouter := scoped(models.ScopeDataDelete)
+	deleteRouter.HandleFunc("/snapshots", makeHttpHandleFunc(s.DeleteSnapshots)).Methods("DELETE")
+
+	auditRouter := scoped(models.ScopeAuditRead)
+	auditRouter.HandleFunc("/audit-events", makeHttpHandleFunc(s.GetAuditEvents)).Methods("GET")
 
 	router.MethodNotAllowedHandler = makeHttpHandleFunc(s.ShowAPIError)
+	// before the limiter so rejected requests are traced, counted and logged
+	router.Use(middleware.Tracing, middleware.AccessLog, middleware.Metrics)
+	// api routes only, frequent probes and scrapes must not be rejected or use up the ip bucket
+	if s.limiter != nil {
+		apiRouter.Use(s.limiter.Middleware)
+	}
 
 	corsOptions := []handlers.CORSOption{
-		handlers.AllowedOrigins([]string{"http://localhost:5173"}),
+		handlers.AllowedOrigins(s.allowedOrigins),
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Token"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Token", "Authorization", middleware.RequestIDHeader}),
+		// session cookie is sent by the frontend
+		handlers.AllowCredentials(),
+		handlers.ExposedHeaders([]string{"Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", middleware.RequestIDHeader}),
 	}
 
-	// initial cron job call fetch indego data every hour
+	// outermost so preflight and not found responses carry the request id too
+	return middleware.RequestID(handlers.CORS(corsOptions...)(router))
+}
+
+// db return the store recording a span of each call under the span in ctx
+func (s *APIServer) db(ctx context.Context) models.Storage {
+	return models.Traced(ctx, s.store)
+}
+
+// background run f in a goroutine waited by shutdown
+func (s *APIServer) background(f func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		f()
+	}()
+}
+
+// Run serve the api and cron jobs until ctx is done, then stop accepting requests and
+// wait for in-flight requests, a running ingestion and its background tasks up to the shutdown timeout
+func (s *APIServer) Run(ctx context.Context) error {
+	// cron job fetch indego data, every hour by default
 	c := cron.New()
-	_, err := c.AddFunc("0 * * * *", func() {
+	_, err := c.AddFunc(s.ingestCron, func() {
 		err := s.FetchIndegoData(nil, nil)
 		if err != nil {
-			log.Printf("Error fetching and storing Indego data: %v", err)
+			slog.Error("Error fetching and storing Indego data", "err", err)
 		}
 	})
 	if err != nil {
-		log.Fatalf("Error adding cron job: %v", err)
+		return fmt.Errorf("failed to add cron job: %v", err)
+	}
+
+	if s.sharedLimit {
+		_, err = c.AddFunc("30 * * * *", func() {
+			if err := s.db(ctx).PruneRateLimits(); err != nil {
+				slog.Error("Error pruning rate limits", "err", err)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add cron job: %v", err)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: s.serverConfig.ReadHeaderTimeout,
+		ReadTimeout:       s.serverConfig.ReadTimeout,
+		WriteTimeout:      s.serverConfig.WriteTimeout,
+		IdleTimeout:       s.serverConfig.IdleTimeout,
+	}
+	// stream connections never become idle, end them so shutdown does not wait for the timeout
+	srv.RegisterOnShutdown(func() { close(s.shutdown) })
+
+	// staleness gauge start from the stored feed, not from the first ingest after restart
+	if at, err := s.db(ctx).GetLastUpdated(); err == nil && at != "" {
+		if t, err := utils.ParseTime(at); err == nil {
+			metrics.SetFeedUpdated(t)
+		}
 	}
 
 	// Start the cron job
 	c.Start()
 
-	log.Println("API running at port", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, handlers.CORS(corsOptions...)(router))
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("API running", "addr", s.listenAddr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		<-c.Stop().Done()
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for in-flight requests and ingestion")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.serverConfig.ShutdownTimeout)
+	defer cancel()
+
+	// no new cron job start, the returned context is done when the running one finish
+	cronDone := c.Stop()
+	err = srv.Shutdown(shutdownCtx)
+
+	tasksDone := make(chan struct{})
+	go func() {
+		<-cronDone.Done()
+		s.tasks.Wait()
+		close(tasksDone)
+	}()
+
+	select {
+	case <-tasksDone:
+	case <-shutdownCtx.Done():
+		err = errors.Join(err, fmt.Errorf("ingestion still running after %v", s.serverConfig.ShutdownTimeout))
+	}
+
+	if err != nil {
+		return err
+	}
+	slog.Info("API stopped")
+	return nil
 }
 
 func (s *APIServer) ShowAPIError(w http.ResponseWriter, r *http.Request) error {
@@ -104,26 +317,76 @@ func (s *APIServer) ShowAPIError(w http.ResponseWriter, r *http.Request) error {
 	return ResponseJSON(w, status, APIResponse{Status: status, Message: errMsg})
 }
 
-func (s *APIServer) FetchIndegoData(w http.ResponseWriter, r *http.Request) error {
-	now := time.Now()
-	apiUrl := "https://bts-status.bicycletransit.workers.dev/phl"
-	resp, err := http.Get(apiUrl)
+// fetchIndego get and decode the latest indego feed
+func fetchIndego(ctx context.Context) (data models.IndegoRes, err error) {
+	ctx, span := tracing.Start(ctx, "indego.fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.URLFull(indegoUrl)))
+	defer func() { tracing.End(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", indegoUrl, nil)
 	if err != nil {
-		return err
+		return data, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return data, err
 	}
 
 	defer resp.Body.Close()
-	var data models.IndegoRes
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return data, err
+	}
+	span.SetAttributes(attribute.Int("indego.stations", len(data.Features)))
+	return data, nil
+}
+
+func (s *APIServer) FetchIndegoData(w http.ResponseWriter, r *http.Request) error {
+	// cron job has no request
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	// parent of the fetch, store and background tasks of one ingestion
+	ctx, span := tracing.Start(ctx, "indego.ingest")
+	defer span.End()
+
+	now := time.Now()
+	data, err := fetchIndego(ctx)
+	if err != nil {
+		metrics.IngestRuns.WithLabelValues("error").Inc()
+		if r != nil {
+			s.audit(r, "", models.AuditIngest, "indego", models.OutcomeFailure, err.Error())
+		}
 		return err
 	}
 
-	log.Printf("Total time used for fetching Indego API %v", time.Since(now))
+	slog.InfoContext(ctx, "Fetched Indego API", "duration", time.Since(now), "stations", len(data.Features))
+	metrics.IngestDuration.WithLabelValues("fetch").Observe(time.Since(now).Seconds())
 
 	now2 := time.Now()
-	err = s.store.StoreIndegoData(&data)
-	log.Printf("Total time used for storing data %v", time.Since(now2))
-	log.Printf("Total function used time %v", time.Since(now))
+	err = s.db(ctx).StoreIndegoData(&data)
+	slog.InfoContext(ctx, "Stored Indego data", "lastUpdated", data.LastUpdated, "duration", time.Since(now2), "total", time.Since(now), "err", err)
+	metrics.IngestDuration.WithLabelValues("store").Observe(time.Since(now2).Seconds())
+	metrics.IngestRuns.WithLabelValues(metrics.Outcome(err)).Inc()
+
+	if err == nil {
+		bikes := 0
+		for _, f := range data.Features {
+			bikes += len(f.Properties.Bikes)
+		}
+		metrics.IngestRows.WithLabelValues("stations").Add(float64(len(data.Features)))
+		metrics.IngestRows.WithLabelValues("bikes").Add(float64(bikes))
+
+		if t, err := utils.ParseTime(data.LastUpdated); err == nil {
+			metrics.SetFeedUpdated(t)
+			snap := Snapshot{At: t.Format("2006-01-02 15:04:05"), Features: data.Features}
+			s.hub.Publish(snap)
+			// tasks outlive the request, keep its trace and request id but not its cancellation
+			taskCtx := context.WithoutCancel(ctx)
+			s.background(func() { s.EvaluateAlerts(taskCtx, snap) })
+			s.background(func() { s.CaptureWeather(taskCtx, snap) })
+		}
+	}
 
 	if w == nil && r == nil {
 		// for cron job
@@ -135,13 +398,15 @@ func (s *APIServer) FetchIndegoData(w http.ResponseWriter, r *http.Request) erro
 
 	status := http.StatusOK
 	if err != nil {
+		s.audit(r, "", models.AuditIngest, "indego", models.OutcomeFailure, err.Error())
 		status = http.StatusBadRequest
 		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Fetch and store indego data failed"})
 	}
+	s.audit(r, "", models.AuditIngest, "indego", models.OutcomeSuccess, data.LastUpdated)
 
 	t, err := utils.ParseTime(data.LastUpdated)
 	if err != nil {
-		fmt.Println("Error parsing time:", err)
+		slog.WarnContext(ctx, "Error parsing time", "err", err)
 		status := http.StatusBadRequest
 		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Invalid time format"})
 	}
@@ -151,10 +416,61 @@ func (s *APIServer) FetchIndegoData(w http.ResponseWriter, r *http.Request) erro
 	return ResponseJSON(w, status, APIResponse{Status: status, Message: "Indego data fetch and store successfully", Data: dateTime})
 }
 
+// parsePage read limit and cursor query for list endpoints, the returned key is the list key stored in cursor
+func parsePage(r *http.Request) (page models.Page, key string, err error) {
+	page.Limit = defaultPageLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		page.Limit, err = strconv.Atoi(l)
+		if err != nil || page.Limit < 1 || page.Limit > maxPageLimit {
+			return page, "", fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		key, page.AfterId, err = utils.DecodeCursor(c)
+		if err != nil {
+			return page, "", err
+		}
+	}
+
+	return page, key, nil
+}
+
+// nextLink return the same request url with cursor pointing after the last id
+func nextLink(r *http.Request, key string, lastId int64) string {
+	q := r.URL.Query()
+	q.Set("cursor", utils.EncodeCursor(key, lastId))
+	return fmt.Sprintf("%v?%v", r.URL.Path, q.Encode())
+}
+
+// fetchPage fetch one more row than page.Limit to know whether there is a next page,
+// it return the rows of the page and the link to the next page, empty on the last page
+func fetchPage[T any](r *http.Request, key string, page models.Page, fetch func(models.Page) ([]T, error), id func(T) int64) ([]T, string, error) {
+	limit := page.Limit
+	page.Limit++
+	rows, err := fetch(page)
+	if err != nil || len(rows) <= limit {
+		return rows, "", err
+	}
+
+	rows = rows[:limit]
+	return rows, nextLink(r, key, id(rows[limit-1])), nil
+}
+
 func (s *APIServer) GetStations(w http.ResponseWriter, r *http.Request) error {
 	now := time.Now()
 	at := r.URL.Query().Get("at")
-	log.Printf("Receive at : %v", at)
+	slog.DebugContext(r.Context(), "Get stations", "at", at)
+
+	page, cursorAt, err := parsePage(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: err.Error()})
+	}
+
+	if at == "" {
+		at = cursorAt
+	}
 	if at == "" {
 		errMsg := "Error : at cannot be empty"
 		status := http.StatusNotFound
@@ -163,44 +479,34 @@ func (s *APIServer) GetStations(w http.ResponseWriter, r *http.Request) error {
 
 	t, err := utils.ParseTime(at)
 	if err != nil {
-		fmt.Println("Error parsing time:", err)
+		slog.WarnContext(r.Context(), "Error parsing time", "err", err)
 		status := http.StatusBadRequest
 		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Invalid time format"})
 	}
 
 	dateTime := t.Format("2006-01-02 15:04:05")
+	if cursorAt != "" && cursorAt != dateTime {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Cursor does not match at"})
+	}
 
-	data, err := s.store.GetStationList(dateTime)
-	log.Printf("Total time used for get all stations data %+v", time.Since(now))
+	data, next, err := fetchPage(r, dateTime, page, func(page models.Page) ([]models.BikeResult, error) {
+		return s.db(r.Context()).GetStationList(dateTime, page)
+	}, func(b models.BikeResult) int64 { return b.Stations.Properties.Id })
+	slog.InfoContext(r.Context(), "Got stations data", "at", dateTime, "rows", len(data), "duration", time.Since(now))
 	status := http.StatusOK
 	if err != nil {
 		status = http.StatusBadRequest
 		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Get stations failed"})
 	}
 
-	// capture station weather
-	now2 := time.Now()
-	api := os.Getenv("OPEN_WEATHER_APIKEY")
-	var wg sync.WaitGroup
-	ch := make(chan models.WeatherResult)
-	for i, v := range data {
-		wg.Add(1)
-		p := v.Stations.Properties
-		go s.FetchWeather(api, i, p.Latitude, p.Longitude, ch, &wg)
-	}
-
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-	log.Printf("Total time used for fetching weather %+v", time.Since(now2))
-	// end
+	s.fillWeather(r.Context(), dateTime, data)
 
-	for result := range ch {
-		data[result.Index].Weather = result.Weather
+	if wantsGeoJSON(r) {
+		return ResponseGeoJSON(w, status, toFeatureCollection(data, next))
 	}
 
-	response := APIResponse{Status: status, Message: "Success", Data: data}
+	response := APIResponse{Status: status, Message: "Success", Data: data, Next: next}
 
 	return ResponseJSON(w, status, response)
 }
@@ -218,15 +524,15 @@ func (s *APIServer) GetStation(w http.ResponseWriter, r *http.Request) error {
 
 	t, err := utils.ParseTime(at)
 	if err != nil {
-		fmt.Println("Error parsing time:", err)
+		slog.WarnContext(r.Context(), "Error parsing time", "err", err)
 		status := http.StatusBadRequest
 		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Invalid time format"})
 	}
 
 	dateTime := t.Format("2006-01-02 15:04:05")
 
-	data, err := s.store.GetStation(dateTime, kioskId)
-	log.Printf("Total time used for get kioskId : %v stations data %+v", kioskId, time.Since(now))
+	data, err := s.db(r.Context()).GetStation(dateTime, kioskId)
+	slog.InfoContext(r.Context(), "Got station data", "kioskId", kioskId, "duration", time.Since(now))
 	status := http.StatusOK
 	if err != nil {
 		if strings.Contains(err.Error(), "empty row") {
@@ -236,74 +542,37 @@ func (s *APIServer) GetStation(w http.ResponseWriter, r *http.Request) error {
 		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Get station failed"})
 	}
 
-	// capture station weather
-	now2 := time.Now()
-	api := os.Getenv("OPEN_WEATHER_APIKEY")
-	var wg sync.WaitGroup
-	ch := make(chan models.WeatherResult)
-	wg.Add(1)
-	p := data.Stations.Properties
-	go s.FetchWeather(api, 0, p.Latitude, p.Longitude, ch, &wg)
-
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-	log.Printf("Total time used for fetching weather %+v", time.Since(now2))
-	// end
-
-	for result := range ch {
-		data.Weather = result.Weather
-	}
+	results := []models.BikeResult{data}
+	s.fillWeather(r.Context(), dateTime, results)
+	data = results[0]
 
 	response := APIResponse{Status: status, Message: "Success", Data: data}
 
 	return ResponseJSON(w, http.StatusOK, response)
 }
 
-func (s *APIServer) FetchWeather(api string, index int, latitude float64, longitude float64, ch chan<- models.WeatherResult, wg *sync.WaitGroup) {
-	defer wg.Done()
-	apiUrl := fmt.Sprintf("https://api.openweathermap.org/data/2.5/weather?lat=%f&lon=%f&appid=%v", latitude, longitude, api)
-	// if more than 10 seconds go timeout
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(apiUrl)
-	if err != nil {
-		log.Printf("Error fetching open weather API %v", err)
-		return
-	}
-
-	defer resp.Body.Close()
-	var data models.Weather
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		log.Printf("Error parsing open weather response err: %v", err)
-		return
+// DeleteSnapshots remove every snapshot stored before the before query
+func (s *APIServer) DeleteSnapshots(w http.ResponseWriter, r *http.Request) error {
+	before := r.URL.Query().Get("before")
+	if before == "" {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Error : before cannot be empty"})
 	}
 
-	ch <- models.WeatherResult{Index: index, Weather: data}
-}
-
-func (s *APIServer) CheckAuth(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("Check auth")
-	if _, ok := cache.Load("user"); ok {
-		return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Authorized"})
+	t, err := utils.ParseTime(before)
+	if err != nil {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Invalid time format"})
 	}
-	return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Unauthorized"})
-}
 
-func (s *APIServer) Login(w http.ResponseWriter, r *http.Request) error {
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	if username == "user" && password == "123456" {
-		cache.Store(username, true)
-		return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success"})
+	dateTime := t.Format("2006-01-02 15:04:05")
+	deleted, err := s.db(r.Context()).DeleteSnapshotsBefore(dateTime)
+	if err != nil {
+		s.audit(r, "", models.AuditDataDelete, "before "+dateTime, models.OutcomeFailure, err.Error())
+		return err
 	}
+	s.audit(r, "", models.AuditDataDelete, "before "+dateTime, models.OutcomeSuccess, fmt.Sprintf("%d station rows", deleted))
 
-	return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Login failed"})
-}
-
-func (s *APIServer) Logout(w http.ResponseWriter, r *http.Request) error {
-	cache.Store("user", false)
-
-	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success"})
+	slog.InfoContext(r.Context(), "Deleted snapshots", "rows", deleted, "before", dateTime)
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: deleted})
 }
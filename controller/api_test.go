@@ -1,18 +1,50 @@
 package controller
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/logging"
+	"github.com/waiwen1001/bike/metrics"
+	"github.com/waiwen1001/bike/middleware"
 	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
+	"github.com/waiwen1001/bike/weather"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	_ "github.com/lib/pq"
 )
@@ -42,7 +74,9 @@ func TestMain(m *testing.M) {
 
 	defer db.Close()
 
-	ApiServer = NewAPIServer(":8080", testPostgres)
+	cfg := config.Default()
+	cfg.Server.Addr = ":8080"
+	ApiServer = NewAPIServer(cfg, testPostgres)
 
 	exitCode := m.Run()
 	os.Exit(exitCode)
@@ -90,3 +124,1138 @@ func TestGetStation(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Contains(t, rr.Body.String(), "Success")
 }
+
+func TestParsePage(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/stations?at=2024-11-08T07:30:11.051Z&limit=20", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, key, err := parsePage(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, page.Limit)
+	assert.Equal(t, "", key)
+
+	next := nextLink(req, "2024-11-08 07:30:11", 3005)
+	req, err = http.NewRequest("GET", next, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, key, err = parsePage(req)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3005), page.AfterId)
+	assert.Equal(t, "2024-11-08 07:30:11", key)
+}
+
+func TestGetStationsInvalidLimit(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/stations?at=2024-11-08T07:30:11.051Z&limit=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(makeHttpHandleFunc(ApiServer.GetStations))
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "limit must be between")
+}
+
+func TestToFeatureCollection(t *testing.T) {
+	data := []models.BikeResult{
+		{
+			At: "2024-11-08 07:30:11",
+			Stations: models.Feature{
+				Type:       "Feature",
+				Geometry:   models.Geometry{Type: "Point", Coordinates: []float64{-75.16374, 39.95378}},
+				Properties: models.Properties{Id: 3005, KioskId: 3005, Name: "Welcome Park"},
+			},
+		},
+	}
+
+	fc := toFeatureCollection(data, "")
+	assert.Equal(t, "FeatureCollection", fc.Type)
+	assert.Len(t, fc.Features, 1)
+	assert.Equal(t, "Feature", fc.Features[0].Type)
+	assert.Equal(t, "2024-11-08 07:30:11", fc.Features[0].Properties.At)
+
+	b, err := json.Marshal(fc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(b), `"kioskId":3005`)
+	assert.NotContains(t, string(b), `"next"`)
+}
+
+func TestExportInvalidParams(t *testing.T) {
+	tests := []struct {
+		url string
+		msg string
+	}{
+		{"/api/v1/export?format=csv", "from and to cannot be empty"},
+		{"/api/v1/export?from=2024-11-09T00:00:00Z&to=2024-11-08T00:00:00Z", "to must be after from"},
+		{"/api/v1/export?from=2024-11-08T00:00:00Z&to=2024-11-09T00:00:00Z&format=xml", "invalid format"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(makeHttpHandleFunc(ApiServer.Export))
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), tt.msg)
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	store := newMemStore()
+	store.addSnapshot("2024-11-08 07:30:11", models.Properties{Id: 1, KioskId: 3005, Name: "Station", BikesAvailable: 3}, models.Properties{Id: 2, KioskId: 3006})
+	s := &APIServer{store: store}
+
+	rr := httptest.NewRecorder()
+	makeHttpHandleFunc(s.Export)(rr, httptest.NewRequest("GET", "/api/v1/export?from=2024-11-08T00:00:00Z&to=2024-11-09T00:00:00Z&format=parquet", nil))
+	// header as sent with the first byte, not as changed afterwards
+	res := rr.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/vnd.apache.parquet", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="export.parquet"`, res.Header.Get("Content-Disposition"))
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(rr.Body.Bytes()), new(models.ExportStation), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	rows := make([]models.ExportStation, pr.GetNumRows())
+	assert.Nil(t, pr.Read(&rows))
+	assert.Len(t, rows, 2)
+	assert.Equal(t, int64(3005), rows[0].KioskId)
+	assert.Equal(t, "Station", rows[0].Name)
+}
+
+func TestStreamDiff(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/stream?kioskIds=3005,3006", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := parseStreamFilter(req)
+	assert.Nil(t, err)
+
+	hub := NewHub()
+	sub := hub.Subscribe(filter)
+	defer hub.Unsubscribe(sub)
+
+	snap := Snapshot{At: "2024-11-08 07:30:11", Features: []models.Feature{
+		{Properties: models.Properties{KioskId: 3005, BikesAvailable: 3}},
+		{Properties: models.Properties{KioskId: 3006, BikesAvailable: 5}},
+		{Properties: models.Properties{KioskId: 3007, BikesAvailable: 1}},
+	}}
+	assert.Len(t, sub.diff(snap), 2)
+
+	hub.Publish(Snapshot{At: "2024-11-08 08:30:11", Features: []models.Feature{
+		{Properties: models.Properties{KioskId: 3005, BikesAvailable: 2}},
+		{Properties: models.Properties{KioskId: 3006, BikesAvailable: 5}},
+	}})
+
+	changed := sub.diff(<-sub.ch)
+	assert.Len(t, changed, 1)
+	assert.Equal(t, int64(3005), changed[0].Properties.KioskId)
+}
+
+func TestParseStreamFilterInvalidBBox(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/stream?bbox=1,2,3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = parseStreamFilter(req)
+	assert.NotNil(t, err)
+}
+
+func TestValidateAlertRule(t *testing.T) {
+	rule := models.AlertRule{Condition: models.AlertBikesBelow, Threshold: 2, DurationMinutes: 15, WebhookUrl: "https://example.com/hook"}
+	assert.Nil(t, validateAlertRule(rule))
+
+	rule.Condition = "bikes_above"
+	assert.NotNil(t, validateAlertRule(rule))
+
+	rule = models.AlertRule{Condition: models.AlertStatusIs, WebhookUrl: "ftp://example.com"}
+	assert.NotNil(t, validateAlertRule(rule))
+}
+
+func TestAlertConditionMet(t *testing.T) {
+	p := models.Properties{KioskId: 3005, BikesAvailable: 1, DocksAvailable: 10, KioskPublicStatus: "Unavailable"}
+
+	assert.True(t, alertConditionMet(models.AlertRule{Condition: models.AlertBikesBelow, Threshold: 2}, p))
+	assert.False(t, alertConditionMet(models.AlertRule{Condition: models.AlertDocksBelow, Threshold: 2}, p))
+	assert.True(t, alertConditionMet(models.AlertRule{Condition: models.AlertStatusIs, Status: "unavailable"}, p))
+}
+
+func TestPostWebhookSignature(t *testing.T) {
+	body := []byte(`{"ruleId":1}`)
+	signature := signPayload("secret", body)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sha256="+signature, r.Header.Get("X-Bike-Signature"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	code, err := postWebhook(ts.URL, 1, signature, body)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, code)
+}
+
+func TestWeatherCacheSharesCell(t *testing.T) {
+	c := NewWeatherCache(0.01, time.Minute)
+	ctx := context.Background()
+	calls := 0
+	fetch := func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		calls++
+		return models.WeatherReport{Condition: "Clear"}, nil
+	}
+
+	w, stale, err := c.Get(ctx, 39.95378, -75.16374, fetch)
+	assert.Nil(t, err)
+	assert.False(t, stale)
+	assert.Equal(t, "Clear", w.Condition)
+
+	// same grid cell hit cache
+	_, _, err = c.Get(ctx, 39.95101, -75.16902, fetch)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+
+	_, _, err = c.Get(ctx, 39.96378, -75.16374, fetch)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestWeatherCacheServeStaleOnError(t *testing.T) {
+	c := NewWeatherCache(0.01, time.Nanosecond)
+	ctx := context.Background()
+	_, _, err := c.Get(ctx, 39.95378, -75.16374, func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		return models.WeatherReport{Condition: "Clear"}, nil
+	})
+	assert.Nil(t, err)
+
+	failing := func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		return models.WeatherReport{}, fmt.Errorf("quota exceeded")
+	}
+	w, stale, err := c.Get(ctx, 39.95378, -75.16374, failing)
+	assert.Nil(t, err)
+	assert.True(t, stale)
+	assert.Equal(t, "Clear", w.Condition)
+
+	_, _, err = c.Get(ctx, 40.95378, -75.16374, failing)
+	assert.NotNil(t, err)
+}
+
+func TestFetchWeatherCellsBounded(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	provider := providerFunc(func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return models.WeatherReport{}, nil
+	})
+
+	s := &APIServer{weather: NewWeatherCache(0.01, time.Minute), weatherProvider: provider, weatherParallel: 2}
+	var jobs []weatherJob
+	for i := 0; i < 10; i++ {
+		key, lat, lng := s.weather.cell(39.905+float64(i)*0.01, -75.165)
+		jobs = append(jobs, weatherJob{key: key, lat: lat, lng: lng})
+	}
+
+	results := s.fetchWeatherCells(context.Background(), jobs)
+	assert.Len(t, results, 10)
+	assert.LessOrEqual(t, maxRunning, 2)
+
+	// slow provider, calls started before the deadline are the only upstream calls
+	calls := 0
+	slow := providerFunc(func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		return models.WeatherReport{}, nil
+	})
+	s = &APIServer{weather: NewWeatherCache(0.01, time.Minute), weatherProvider: slow, weatherParallel: 2}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	results = s.fetchWeatherCells(ctx, jobs)
+	assert.Len(t, results, 10)
+	assert.Equal(t, context.DeadlineExceeded, results[jobs[9].key].err)
+	mu.Lock()
+	assert.LessOrEqual(t, calls, 2)
+	mu.Unlock()
+
+	// request already ended, nothing is fetched
+	calls = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	s.fetchWeatherCells(ctx, jobs)
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 0, calls)
+	mu.Unlock()
+}
+
+type providerFunc func(context.Context, float64, float64) (models.WeatherReport, error)
+
+func (p providerFunc) Name() string {
+	return "func"
+}
+
+func (p providerFunc) Current(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+	return p(ctx, lat, lng)
+}
+
+func TestWeatherCellSameForFeedAndStoredStation(t *testing.T) {
+	c := NewWeatherCache(0.01, time.Minute)
+	feed := models.Properties{Coordinates: []float64{-75.16374, 39.95378}}
+	stored := models.Properties{Latitude: 39.95378, Longitude: -75.16374}
+
+	feedKey, _, _ := c.cell(stationPosition(feed))
+	storedKey, _, _ := c.cell(stationPosition(stored))
+	assert.Equal(t, feedKey, storedKey)
+}
+
+// stationsAt call GetStations of the snapshot at, in RFC 3339 format
+func stationsAt(t *testing.T, s *APIServer, at string) []models.BikeResult {
+	rr := httptest.NewRecorder()
+	makeHttpHandleFunc(s.GetStations)(rr, httptest.NewRequest("GET", "/api/v1/stations?at="+at, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var res struct{ Data []models.BikeResult }
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	return res.Data
+}
+
+func TestCaptureWeatherServeStored(t *testing.T) {
+	calls := 0
+	provider := providerFunc(func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		calls++
+		return models.WeatherReport{Provider: "func", Condition: "Rain", Temp: 8, Latitude: lat, Longitude: lng}, nil
+	})
+	store := newMemStore()
+	s := &APIServer{store: store, weather: NewWeatherCache(0.01, time.Minute), weatherProvider: provider, weatherParallel: 2, weatherTimeout: time.Second}
+
+	// 3005 and 3006 share a grid cell
+	stations := []models.Properties{
+		{Id: 1, KioskId: 3005, Latitude: 39.95378, Longitude: -75.16374},
+		{Id: 2, KioskId: 3006, Latitude: 39.95101, Longitude: -75.16902},
+		{Id: 3, KioskId: 3007, Latitude: 39.96378, Longitude: -75.16374},
+	}
+	snap := Snapshot{At: "2024-11-08 07:30:11"}
+	for _, p := range stations {
+		snap.Features = append(snap.Features, models.Feature{Properties: p})
+	}
+	store.addSnapshot(snap.At, stations...)
+
+	s.CaptureWeather(context.Background(), snap)
+	assert.Equal(t, 2, calls)
+	obs, err := store.GetWeatherObservations("2024-11-08 00:00:00.000", "2024-11-09 00:00:00.999")
+	assert.Nil(t, err)
+	assert.Len(t, obs, 2)
+
+	// past snapshot use the stored observation, provider is not called again
+	data := stationsAt(t, s, "2024-11-08T07:30:11Z")
+	assert.Len(t, data, 3)
+	for _, d := range data {
+		assert.Equal(t, WeatherOk, d.WeatherStatus)
+		assert.Equal(t, "Rain", d.Weather.Weather[0].Main)
+	}
+	assert.Equal(t, 2, calls)
+
+	// observation is matched within models.WeatherMatchWindow of the snapshot only
+	store.addSnapshot("2024-11-08 10:29:11", stations...)
+	store.addSnapshot("2024-11-08 10:31:11", stations...)
+	data = stationsAt(t, s, "2024-11-08T10:29:11Z")
+	assert.Equal(t, WeatherStale, data[0].WeatherStatus)
+	assert.Equal(t, "Rain", data[0].Weather.Weather[0].Main)
+	data = stationsAt(t, s, "2024-11-08T10:31:11Z")
+	assert.Equal(t, WeatherUnavailable, data[0].WeatherStatus)
+	assert.Empty(t, data[0].Weather.Weather)
+	assert.Equal(t, 2, calls)
+}
+
+func TestWeatherStatus(t *testing.T) {
+	station := models.Properties{Id: 1, KioskId: 3005, Latitude: 39.95378, Longitude: -75.16374}
+	recent := time.Now().UTC().Add(-10 * time.Minute).Format("2006-01-02 15:04:05")
+	tests := []struct {
+		name string
+		at   string
+		// snapshot of the stored observation, empty when nothing stored
+		observed string
+		// cache hold an expired entry of the station cell
+		cached bool
+		status string
+		calls  int
+	}{
+		{"stored for the snapshot", "2024-11-08 07:30:11", "2024-11-08 07:30:11", false, WeatherOk, 0},
+		{"stored for a neighbour snapshot", "2024-11-08 07:30:11", "2024-11-08 07:45:11", false, WeatherStale, 0},
+		{"old snapshot without weather", "2024-11-08 07:30:11", "", true, WeatherUnavailable, 0},
+		{"live fetch failure with expired cache", recent, "", true, WeatherStale, 1},
+	}
+
+	for _, tt := range tests {
+		store := newMemStore()
+		store.addSnapshot(tt.at, station)
+		cache := NewWeatherCache(0.01, time.Nanosecond)
+		key, lat, lng := cache.cell(station.Latitude, station.Longitude)
+		if tt.observed != "" {
+			store.StoreWeatherObservations(tt.observed, []models.WeatherObservation{{Cell: key, Latitude: lat, Longitude: lng, Report: models.WeatherReport{Condition: "Rain"}}})
+		}
+		if tt.cached {
+			cache.Get(context.Background(), lat, lng, func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+				return models.WeatherReport{Condition: "Rain"}, nil
+			})
+		}
+
+		calls := 0
+		provider := providerFunc(func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+			calls++
+			return models.WeatherReport{}, fmt.Errorf("quota exceeded")
+		})
+		s := &APIServer{store: store, weather: cache, weatherProvider: provider, weatherParallel: 2, weatherTimeout: time.Second}
+
+		at, _ := time.Parse("2006-01-02 15:04:05", tt.at)
+		data := stationsAt(t, s, at.Format(time.RFC3339))
+		assert.Len(t, data, 1, tt.name)
+		assert.Equal(t, tt.status, data[0].WeatherStatus, tt.name)
+		if tt.status != WeatherUnavailable {
+			assert.Equal(t, "Rain", data[0].Weather.Weather[0].Main, tt.name)
+		}
+		assert.Equal(t, tt.calls, calls, tt.name)
+	}
+}
+
+func TestBackfillWeatherResume(t *testing.T) {
+	store := newMemStore()
+	for _, at := range []string{"2024-11-08 07:30:11", "2024-11-08 07:45:11"} {
+		store.addSnapshot(at,
+			models.Properties{Id: 1, KioskId: 3005, Latitude: 39.94733, Longitude: -75.14403},
+			models.Properties{Id: 2, KioskId: 3006, Latitude: 39.94761, Longitude: -75.14491},
+			models.Properties{Id: 3, KioskId: 3007, Latitude: 39.98003, Longitude: -75.16746})
+	}
+	s := &APIServer{store: store, weather: NewWeatherCache(0.01, time.Minute)}
+	provider, err := weather.NewFixture("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := s.BackfillWeather(context.Background(), "2024-11-08 00:00:00.000", "2024-11-09 00:00:00.999", provider)
+	assert.Nil(t, err)
+	// 2 cells for each of 2 snapshots
+	assert.Equal(t, 4, total)
+
+	total, err = s.BackfillWeather(context.Background(), "2024-11-08 00:00:00.000", "2024-11-09 00:00:00.999", provider)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, total)
+}
+
+func TestWeatherImpactAggregator(t *testing.T) {
+	agg := newImpactAggregator()
+	rain := &models.WeatherReport{Temp: -2.5, Condition: "Rain", Precipitation: 3, WindSpeed: 9}
+	clear := &models.WeatherReport{Temp: 12, Condition: "Clear", WindSpeed: 1}
+
+	agg.add(3005, 10, 5, clear)
+	agg.add(3005, 4, 11, rain)
+	agg.add(3005, 6, 9, nil)
+	agg.add(3005, 8, 7, clear)
+
+	res := agg.result()
+	assert.Equal(t, int64(3), res.Samples)
+	assert.Equal(t, int64(1), res.Unmatched)
+
+	// sorted numerically, -5 before 10
+	assert.Equal(t, "-5 to 0", res.ByTemperature[0].Bucket)
+	assert.Equal(t, "10 to 15", res.ByTemperature[1].Bucket)
+
+	assert.Equal(t, "none", res.ByPrecipitation[0].Bucket)
+	assert.Equal(t, "moderate", res.ByPrecipitation[1].Bucket)
+	assert.Equal(t, "calm", res.ByWind[0].Bucket)
+	assert.Equal(t, "strong", res.ByWind[1].Bucket)
+
+	cleared := res.ByCondition[0]
+	assert.Equal(t, "Clear", cleared.Bucket)
+	assert.Equal(t, int64(2), cleared.Samples)
+	assert.Equal(t, 9.0, cleared.AvgBikesAvailable)
+	// first sample has no previous snapshot, second compare with the unmatched sample
+	assert.Equal(t, 2.0, cleared.AvgTurnover)
+	assert.Equal(t, 6.0, res.ByCondition[1].AvgTurnover)
+}
+
+func TestWeatherImpactKioskFilter(t *testing.T) {
+	store := newMemStore()
+	store.addSnapshot("2024-11-08 07:30:11", models.Properties{Id: 1, KioskId: 3005, BikesAvailable: 4}, models.Properties{Id: 2, KioskId: 3006, BikesAvailable: 7})
+	store.addSnapshot("2024-11-08 07:45:11", models.Properties{Id: 1, KioskId: 3005, BikesAvailable: 4}, models.Properties{Id: 2, KioskId: 3006, BikesAvailable: 7})
+	s := &APIServer{store: store, weather: NewWeatherCache(0.01, time.Hour)}
+	call := func(query string) (int, WeatherImpact) {
+		rr := httptest.NewRecorder()
+		makeHttpHandleFunc(s.GetWeatherImpact)(rr, httptest.NewRequest("GET", "/api/v1/analytics/weather-impact?from=2024-11-08T00:00:00Z&to=2024-11-09T00:00:00Z"+query, nil))
+		var res struct{ Data WeatherImpact }
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		return rr.Code, res.Data
+	}
+
+	// 2 snapshots of the kiosk, without weather
+	code, res := call("&kioskId=3006")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(2), res.Unmatched)
+
+	_, res = call("")
+	assert.Equal(t, int64(4), res.Unmatched)
+
+	code, _ = call("&kioskId=abc")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func login(s *APIServer, username string, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/v1/login", strings.NewReader(url.Values{"username": {username}, "password": {password}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	makeHttpHandleFunc(s.Login)(rr, req)
+	return rr
+}
+
+func withCookies(req *http.Request, rr *httptest.ResponseRecorder) *http.Request {
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestLoginSessions(t *testing.T) {
+	store := newMemStore()
+	s := &APIServer{store: store, sessionTTL: time.Hour, secureCookie: true}
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := s.CreateUser(context.Background(), name, "password-"+name, models.RoleViewer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := s.CreateUser(context.Background(), "carol", "short", models.RoleViewer)
+	assert.NotNil(t, err)
+	_, err = s.CreateUser(context.Background(), "carol", "password-carol", "owner")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, login(s, "alice", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, login(s, "nobody", "password-alice").Code)
+
+	alice := login(s, "alice", "password-alice")
+	assert.Equal(t, http.StatusOK, alice.Code)
+	cookies := alice.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.True(t, cookies[0].Secure)
+	bob := login(s, "bob", "password-bob")
+
+	rr := httptest.NewRecorder()
+	makeHttpHandleFunc(s.CheckAuth)(rr, withCookies(httptest.NewRequest("GET", "/api/v1/check-auth", nil), alice))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var res struct{ Data models.User }
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	assert.Equal(t, "alice", res.Data.Username)
+
+	// alice logout must not end bob session
+	rr = httptest.NewRecorder()
+	makeHttpHandleFunc(s.Logout)(rr, withCookies(httptest.NewRequest("POST", "/api/v1/logout", nil), alice))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	makeHttpHandleFunc(s.CheckAuth)(rr, withCookies(httptest.NewRequest("GET", "/api/v1/check-auth", nil), alice))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	makeHttpHandleFunc(s.CheckAuth)(rr, withCookies(httptest.NewRequest("GET", "/api/v1/check-auth", nil), bob))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	makeHttpHandleFunc(s.CheckAuth)(rr, httptest.NewRequest("GET", "/api/v1/check-auth", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// 2 failed logins, 2 logins and alice logout
+	outcomes := []string{}
+	for _, e := range store.events {
+		outcomes = append(outcomes, e.Actor+" "+e.Action+" "+e.Outcome)
+	}
+	assert.Equal(t, []string{"user:alice login failure", "user:nobody login failure", "user:alice login success", "user:bob login success", "user:alice logout success"}, outcomes)
+}
+
+func TestLoginAuditLongUsername(t *testing.T) {
+	store := newMemStore()
+	s := &APIServer{store: store, sessionTTL: time.Hour}
+
+	name := strings.Repeat("é", 1000)
+	assert.Equal(t, http.StatusUnauthorized, login(s, name, "password").Code)
+
+	// actor column is VARCHAR(255), a longer value would fail the insert
+	assert.Len(t, store.events, 1)
+	assert.Equal(t, 255, utf8.RuneCountInString(store.events[0].Actor))
+	assert.True(t, strings.HasPrefix(store.events[0].Actor, "user:éé"))
+	assert.True(t, strings.HasSuffix(store.events[0].Actor, "..."))
+}
+
+// mockOIDC is a minimal OIDC provider issuing RS256 id tokens for the nonce of the last authorize request
+type mockOIDC struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	nonce  string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockOIDC{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.server.URL,
+			"authorization_endpoint":                m.server.URL + "/authorize",
+			"token_endpoint":                        m.server.URL + "/token",
+			"jwks_uri":                              m.server.URL + "/jwks",
+			"end_session_endpoint":                  m.server.URL + "/logout",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": m.idToken(t)})
+	})
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockOIDC) idToken(t *testing.T) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": m.server.URL, "aud": "bike-client", "sub": "auth0|42", "email": "rider@example.com",
+		"nonce": m.nonce, "iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	provider := newMockOIDC(t)
+	defer provider.server.Close()
+
+	store := newMemStore()
+	s := &APIServer{store: store, sessionTTL: time.Hour, oidc: NewOIDCAuth(provider.server.URL, "bike-client", "secret", "http://localhost:3000/api/v1/callback", "http://localhost:5173")}
+
+	rr := httptest.NewRecorder()
+	makeHttpHandleFunc(s.OIDCLogin)(rr, httptest.NewRequest("GET", "/api/v1/login", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	authUrl, err := url.Parse(rr.Header().Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, "/authorize", authUrl.Path)
+	assert.Equal(t, "S256", authUrl.Query().Get("code_challenge_method"))
+	provider.nonce = authUrl.Query().Get("nonce")
+	state := authUrl.Query().Get("state")
+
+	// wrong state is rejected before code exchange
+	bad := httptest.NewRecorder()
+	makeHttpHandleFunc(s.OIDCCallback)(bad, withCookies(httptest.NewRequest("GET", "/api/v1/callback?code=good-code&state=other", nil), rr))
+	assert.Equal(t, http.StatusBadRequest, bad.Code)
+
+	cb := httptest.NewRecorder()
+	makeHttpHandleFunc(s.OIDCCallback)(cb, withCookies(httptest.NewRequest("GET", "/api/v1/callback?code=good-code&state="+state, nil), rr))
+	assert.Equal(t, http.StatusFound, cb.Code)
+	assert.Equal(t, "http://localhost:5173", cb.Header().Get("Location"))
+
+	check := httptest.NewRecorder()
+	makeHttpHandleFunc(s.CheckAuth)(check, withCookies(httptest.NewRequest("GET", "/api/v1/check-auth", nil), cb))
+	assert.Equal(t, http.StatusOK, check.Code)
+	var res struct{ Data models.User }
+	json.Unmarshal(check.Body.Bytes(), &res)
+	assert.Equal(t, "rider@example.com", res.Data.Username)
+
+	// token signed for another nonce fail verification
+	provider.nonce = "replayed"
+	replay := httptest.NewRecorder()
+	makeHttpHandleFunc(s.OIDCCallback)(replay, withCookies(httptest.NewRequest("GET", "/api/v1/callback?code=good-code&state="+state, nil), rr))
+	assert.Equal(t, http.StatusUnauthorized, replay.Code)
+
+	out := httptest.NewRecorder()
+	makeHttpHandleFunc(s.Logout)(out, withCookies(httptest.NewRequest("POST", "/api/v1/logout", nil), cb))
+	var logout struct{ Data map[string]string }
+	json.Unmarshal(out.Body.Bytes(), &logout)
+	assert.Contains(t, logout.Data["logoutUrl"], provider.server.URL+"/logout?")
+}
+
+func TestAlertPagination(t *testing.T) {
+	store := newMemStore()
+	for i := int64(1); i <= 3; i++ {
+		store.rules = append(store.rules, models.AlertRule{Id: i, Secret: "secret"})
+		store.deliveries = append(store.deliveries, models.AlertDelivery{Id: i, RuleId: 1})
+	}
+	s := &APIServer{store: store}
+	handler := s.Handler()
+	reader, _ := s.IssueAPIKey(context.Background(), "dashboard", "ops", models.RoleViewer, nil, nil)
+	list := func(path string) (int, []map[string]any, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Token", reader.Key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var res struct {
+			Data []map[string]any
+			Next string
+		}
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		return rr.Code, res.Data, res.Next
+	}
+
+	code, rules, next := list("/api/v1/alerts?limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, rules, 2)
+	assert.Nil(t, rules[0]["secret"])
+	assert.NotEmpty(t, next)
+	_, rules, next = list(next)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, 3.0, rules[0]["id"])
+	assert.Empty(t, next)
+
+	// exactly limit rows left, no link to an empty page
+	_, _, next = list("/api/v1/alerts?limit=3")
+	assert.Empty(t, next)
+
+	_, deliveries, next := list("/api/v1/alerts/1/deliveries?limit=2")
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, 3.0, deliveries[0]["id"])
+	_, deliveries, next = list(next)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, 1.0, deliveries[0]["id"])
+	assert.Empty(t, next)
+
+	code, _, _ = list("/api/v1/alerts?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	store := newMemStore()
+	s := &APIServer{store: store}
+	handler := s.Handler()
+	call := func(method string, path string, token string, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Token", token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	_, err := s.IssueAPIKey(context.Background(), "bad", "ops", models.RoleViewer, []string{"stations:write"}, nil)
+	assert.NotNil(t, err)
+	// scopes can not widen the role
+	_, err = s.IssueAPIKey(context.Background(), "bad", "ops", models.RoleViewer, []string{models.ScopeIngestWrite}, nil)
+	assert.NotNil(t, err)
+
+	reader, err := s.IssueAPIKey(context.Background(), "dashboard", "ops", models.RoleViewer, nil, nil)
+	assert.Nil(t, err)
+	admin, err := s.IssueAPIKey(context.Background(), "root", "ops", models.RoleAdmin, nil, nil)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(reader.Key, reader.Prefix))
+	assert.NotEqual(t, reader.Key, store.keys[0].KeyHash)
+
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/v1/alerts", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/v1/alerts", "bike001", ""))
+	assert.Equal(t, http.StatusOK, call("GET", "/api/v1/alerts", reader.Key, ""))
+	assert.True(t, store.touched[reader.Id])
+
+	// reader can not write alerts or manage keys, admin has every scope
+	assert.Equal(t, http.StatusForbidden, call("POST", "/api/v1/alerts", reader.Key, "{}"))
+	assert.Equal(t, http.StatusForbidden, call("GET", "/api/v1/api-keys", reader.Key, ""))
+	assert.Equal(t, http.StatusOK, call("GET", "/api/v1/api-keys", admin.Key, ""))
+	assert.Equal(t, http.StatusCreated, call("POST", "/api/v1/api-keys", admin.Key, `{"name": "ingest", "owner": "cron", "role": "operator", "scopes": ["ingest:write"]}`))
+
+	assert.Equal(t, http.StatusOK, call("DELETE", fmt.Sprintf("/api/v1/api-keys/%d", reader.Id), admin.Key, ""))
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/v1/alerts", reader.Key, ""))
+
+	expired := time.Now().Add(-time.Minute)
+	store.keys[admin.Id-1].ExpiresAt = &expired
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/v1/api-keys", admin.Key, ""))
+}
+
+func TestAPIKeyPagination(t *testing.T) {
+	store := newMemStore()
+	s := &APIServer{store: store}
+	handler := s.Handler()
+	admin, _ := s.IssueAPIKey(context.Background(), "root", "ops", models.RoleAdmin, nil, nil)
+	for _, name := range []string{"a", "b"} {
+		s.IssueAPIKey(context.Background(), name, "ops", models.RoleViewer, nil, nil)
+	}
+	list := func(path string) ([]models.APIKey, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Token", admin.Key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var res struct {
+			Data []models.APIKey
+			Next string
+		}
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		return res.Data, res.Next
+	}
+
+	keys, next := list("/api/v1/api-keys?limit=2")
+	assert.Len(t, keys, 2)
+	assert.Equal(t, "root", keys[0].Name)
+	keys, next = list(next)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, "b", keys[0].Name)
+	assert.Empty(t, next)
+}
+
+func TestAuditEvents(t *testing.T) {
+	store := newMemStore()
+	s := &APIServer{store: store}
+	handler := s.Handler()
+	call := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Token", token)
+		req.Header.Set("User-Agent", "audit-test")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	reader, err := s.IssueAPIKey(context.Background(), "dashboard", "ops", models.RoleViewer, nil, nil)
+	assert.Nil(t, err)
+	admin, err := s.IssueAPIKey(context.Background(), "root", "ops", models.RoleAdmin, nil, nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/v1/alerts", "bk_0123456789abcdef", "").Code)
+	assert.Equal(t, http.StatusForbidden, call("GET", "/api/v1/audit-events", reader.Key, "").Code)
+	assert.Equal(t, http.StatusCreated, call("POST", "/api/v1/api-keys", admin.Key, `{"name": "ingest", "owner": "cron", "role": "operator"}`).Code)
+	assert.Equal(t, http.StatusOK, call("DELETE", fmt.Sprintf("/api/v1/api-keys/%d", reader.Id), admin.Key, "").Code)
+
+	assert.Equal(t, 4, len(store.events))
+	rejected := store.events[0]
+	assert.Equal(t, models.AuditAuthRejected, rejected.Action)
+	assert.Equal(t, "api_key:bk_01234567", rejected.Actor)
+	assert.Equal(t, "GET /api/v1/alerts", rejected.Target)
+	assert.Equal(t, "192.0.2.1", rejected.IP)
+	assert.Equal(t, "audit-test", rejected.UserAgent)
+
+	forbidden := store.events[1]
+	assert.Equal(t, models.AuditAuthForbidden, forbidden.Action)
+	assert.Equal(t, models.OutcomeDenied, forbidden.Outcome)
+	assert.Equal(t, fmt.Sprintf("api_key:%d", reader.Id), forbidden.Actor)
+
+	assert.Equal(t, models.AuditKeyIssue, store.events[2].Action)
+	assert.Equal(t, fmt.Sprintf("api_key:%d", admin.Id), store.events[2].Actor)
+	assert.Equal(t, models.AuditKeyRevoke, store.events[3].Action)
+	assert.Equal(t, fmt.Sprintf("api_key:%d", reader.Id), store.events[3].Target)
+
+	var res struct {
+		Data []models.AuditEvent
+		Next string
+	}
+	rr := call("GET", "/api/v1/audit-events?outcome=success&limit=1", admin.Key, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+	assert.Equal(t, 1, len(res.Data))
+	assert.Equal(t, models.AuditKeyRevoke, res.Data[0].Action)
+	assert.NotEmpty(t, res.Next)
+
+	rr = call("GET", res.Next, admin.Key, "")
+	res.Data, res.Next = nil, ""
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&res))
+	assert.Equal(t, models.AuditKeyIssue, res.Data[0].Action)
+	// last success event fill the page, no link to an empty page
+	assert.Empty(t, res.Next)
+
+	assert.Equal(t, http.StatusBadRequest, call("GET", "/api/v1/audit-events?outcome=ok", admin.Key, "").Code)
+	assert.Equal(t, http.StatusBadRequest, call("GET", "/api/v1/audit-events?from=2024-11-09T00:00:00Z&to=2024-11-08T00:00:00Z", admin.Key, "").Code)
+}
+
+func TestRunGracefulShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cfg := config.Default()
+	s := &APIServer{listenAddr: addr, store: newMemStore(), hub: NewHub(),
+		ingestCron: cfg.Server.IngestCron, serverConfig: cfg.Server, shutdown: make(chan struct{})}
+	key, err := s.IssueAPIKey(context.Background(), "stream", "ops", models.RoleViewer, nil, nil)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Run(ctx) }()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/api/v1/stream", nil)
+		req.Header.Set("Token", key.Key)
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// background task started by an ingest is waited
+	done := false
+	s.background(func() {
+		time.Sleep(100 * time.Millisecond)
+		done = true
+	})
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	assert.True(t, done)
+
+	// open stream is ended by shutdown
+	_, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	store := newMemStore()
+	cfg := config.Default()
+	s := &APIServer{store: store, serverConfig: cfg.Server}
+	handler := s.Handler()
+	call := func(path string) (int, APIResponse) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var res APIResponse
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		return rr.Code, res
+	}
+
+	code, _ := call("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, res := call("/version")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, res.Data.(map[string]any)["goVersion"])
+
+	// empty database is ready for the first ingest
+	code, _ = call("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	store.addSnapshot(time.Now().UTC().Add(-3*time.Hour).Format("2006-01-02 15:04:05"), models.Properties{Id: 1, KioskId: 3005})
+	code, res = call("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, false, res.Data.(map[string]any)["ingest"].(map[string]any)["ok"])
+
+	store.addSnapshot(time.Now().UTC().Add(-30*time.Minute).Format("2006-01-02 15:04:05"), models.Properties{Id: 1, KioskId: 3005})
+	code, _ = call("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	store.version = models.SchemaVersion - 1
+	code, _ = call("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	store.pingErr = fmt.Errorf("connection refused")
+	code, res = call("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "connection refused", res.Data.(map[string]any)["database"].(map[string]any)["message"])
+}
+
+func TestProbesSkipRateLimit(t *testing.T) {
+	one := map[string]middleware.RateLimit{"default": {Rate: 0.01, Burst: 1}}
+	s := &APIServer{store: newMemStore(), serverConfig: config.Default().Server,
+		limiter: middleware.NewRateLimiter(middleware.NewMemoryRateLimitStore(), one, one, false)}
+	handler := s.Handler()
+	call := func(path string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{"/healthz", "/readyz", "/version", "/metrics"} {
+			assert.Equal(t, http.StatusOK, call(path), path)
+		}
+	}
+
+	// probes did not use the ip bucket of api routes
+	assert.NotEqual(t, http.StatusTooManyRequests, call("/api/v1/check-auth"))
+	assert.Equal(t, http.StatusTooManyRequests, call("/api/v1/check-auth"))
+}
+
+func TestMetrics(t *testing.T) {
+	s := &APIServer{store: newMemStore(), serverConfig: config.Default().Server}
+	handler := s.Handler()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	cache := NewWeatherCache(0.01, time.Hour)
+	fetch := func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		return models.WeatherReport{Provider: "fake"}, nil
+	}
+	hits := testutil.ToFloat64(metrics.WeatherCache.WithLabelValues("hit"))
+	cache.Get(context.Background(), 39.95, -75.16, fetch)
+	cache.Get(context.Background(), 39.95, -75.16, fetch)
+	assert.Equal(t, hits+1, testutil.ToFloat64(metrics.WeatherCache.WithLabelValues("hit")))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	// route label is the template so ids do not make new series
+	assert.Contains(t, body, `bike_http_requests_total{method="GET",route="/healthz",status="200"}`)
+	assert.Contains(t, body, "bike_weather_cache_hit_ratio")
+	assert.Contains(t, body, "bike_feed_staleness_seconds")
+}
+
+func TestStorageErrorLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&buf, config.Log{Level: "info", Format: "json"}))
+
+	store := newMemStore()
+	store.pingErr = fmt.Errorf("connection refused")
+	s := &APIServer{store: store, serverConfig: config.Default().Server}
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	req.Header.Set(middleware.RequestIDHeader, "req-456")
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	// store failure is logged with the id of the request
+	var line map[string]any
+	assert.Nil(t, json.NewDecoder(&buf).Decode(&line))
+	assert.Equal(t, "Storage error", line["msg"])
+	assert.Equal(t, "Ping", line["method"])
+	assert.Equal(t, "req-456", line["request_id"])
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTracerProvider(tracing.NewProvider(config.Default().Tracing, sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	provider := providerFunc(func(ctx context.Context, lat float64, lng float64) (models.WeatherReport, error) {
+		return models.WeatherReport{}, fmt.Errorf("quota exceeded")
+	})
+	// one station of this hour without stored weather
+	now := time.Now().UTC()
+	store := newMemStore()
+	store.addSnapshot(now.Format("2006-01-02 15:04:05"), models.Properties{Id: 1, KioskId: 3005, Latitude: 39.94733, Longitude: -75.14403})
+	s := &APIServer{store: store, weather: NewWeatherCache(0.01, time.Minute),
+		weatherProvider: provider, weatherParallel: 2, weatherTimeout: time.Second}
+	key, err := s.IssueAPIKey(context.Background(), "dashboard", "ops", models.RoleViewer, nil, nil)
+	assert.Nil(t, err)
+	exporter.Reset()
+
+	// live weather is fetched for a snapshot of this hour
+	req := httptest.NewRequest("GET", "/api/v1/stations?at="+now.Format(time.RFC3339), nil)
+	req.Header.Set("Token", key.Key)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	// trace of the caller is continued
+	server, ok := spans["GET /api/v1/stations"]
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+
+	for _, name := range []string{"Storage.GetAPIKeyByHash", "Storage.TouchAPIKey", "Storage.GetStationList", "Storage.GetNearestWeather", "weather.current"} {
+		span, ok := spans[name]
+		assert.True(t, ok, name)
+		assert.Equal(t, server.SpanContext.TraceID(), span.SpanContext.TraceID(), name)
+	}
+	assert.Equal(t, server.SpanContext.SpanID(), spans["Storage.GetStationList"].Parent.SpanID())
+	assert.Equal(t, codes.Error, spans["weather.current"].Status.Code)
+	assert.Equal(t, "quota exceeded", spans["weather.current"].Status.Description)
+}
+
+func TestRoleBasedAccess(t *testing.T) {
+	store := newMemStore()
+	store.addSession("viewer-session", models.User{Username: "vera", Role: models.RoleViewer})
+	secret := []byte("shared-secret")
+	s := &APIServer{store: store, jwt: middleware.NewJWTAuth(middleware.JWTConfig{HS256Secret: secret})}
+	handler := s.Handler()
+	call := func(method string, path string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		auth(req)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	viewer := func(r *http.Request) { r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "viewer-session"}) }
+	assert.Equal(t, http.StatusOK, call("GET", "/api/v1/alerts", viewer).Code)
+	rr := call("POST", "/api/v1/alerts", viewer)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "missing permission alerts:write")
+
+	operatorKey, err := s.IssueAPIKey(context.Background(), "ops", "ops", models.RoleOperator, nil, nil)
+	assert.Nil(t, err)
+	operator := func(r *http.Request) { r.Header.Set("Token", operatorKey.Key) }
+	// passes authorization, rejected by body validation
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/api/v1/alerts", operator).Code)
+	rr = call("GET", "/api/v1/api-keys", operator)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "missing permission keys:manage")
+	rr = call("DELETE", "/api/v1/snapshots?before=2024-11-01T00:00:00Z", operator)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "missing permission data:delete")
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "report", "roles": []string{"analyst"}, "exp": time.Now().Add(time.Hour).Unix()}).SignedString(secret)
+	analyst := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	rr = call("POST", "/api/v1/indego-data-fetch-and-store-it-db", analyst)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "missing permission ingest:write")
+
+	adminKey, err := s.IssueAPIKey(context.Background(), "root", "ops", models.RoleAdmin, nil, nil)
+	assert.Nil(t, err)
+	admin := func(r *http.Request) { r.Header.Set("Token", adminKey.Key) }
+	assert.Equal(t, http.StatusBadRequest, call("DELETE", "/api/v1/snapshots", admin).Code)
+	assert.Equal(t, http.StatusOK, call("DELETE", "/api/v1/snapshots?before=2024-11-01T00:00:00Z", admin).Code)
+}
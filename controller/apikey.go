@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/waiwen1001/bike/models"
+)
+
+// prefix of every issued key, the first characters after it are stored to recognise the key
+const (
+	apiKeyPrefix    = "bk_"
+	apiKeyPrefixLen = 8
+)
+
+type apiKeyRequest struct {
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Role      string     `json:"role"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// IssuedAPIKey carry the plain key, it is only returned once when the key is issued
+type IssuedAPIKey struct {
+	models.APIKey
+	Key string `json:"key"`
+}
+
+func validateAPIKeyRequest(req apiKeyRequest) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if strings.TrimSpace(req.Owner) == "" {
+		return fmt.Errorf("owner cannot be empty")
+	}
+	if !models.ValidRole(req.Role) {
+		return fmt.Errorf("role must be one of %v", strings.Join(models.Roles, ", "))
+	}
+	// scopes are optional and can only narrow the role
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.Scopes, scope) {
+			return fmt.Errorf("scope must be one of %v", strings.Join(models.Scopes, ", "))
+		}
+		if !models.RoleAllows(req.Role, scope) {
+			return fmt.Errorf("scope %v is not granted to role %v", scope, req.Role)
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return fmt.Errorf("expiresAt must be in the future")
+	}
+	return nil
+}
+
+// IssueAPIKey generate a key and store its hash, used by the admin endpoint and create-api-key command
+func (s *APIServer) IssueAPIKey(ctx context.Context, name string, owner string, role string, scopes []string, expiresAt *time.Time) (IssuedAPIKey, error) {
+	req := apiKeyRequest{Name: name, Owner: owner, Role: role, Scopes: scopes, ExpiresAt: expiresAt}
+	if err := validateAPIKeyRequest(req); err != nil {
+		return IssuedAPIKey{}, err
+	}
+
+	secret, err := newSessionToken()
+	if err != nil {
+		return IssuedAPIKey{}, err
+	}
+
+	key := apiKeyPrefix + secret
+	k := models.APIKey{
+		Name:      name,
+		Owner:     owner,
+		Prefix:    key[:len(apiKeyPrefix)+apiKeyPrefixLen],
+		KeyHash:   models.HashToken(key),
+		Role:      role,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.db(ctx).CreateAPIKey(&k); err != nil {
+		return IssuedAPIKey{}, err
+	}
+
+	return IssuedAPIKey{APIKey: k, Key: key}, nil
+}
+
+func (s *APIServer) GetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	page, _, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+
+	keys, next, err := fetchPage(r, "", page, s.db(r.Context()).GetAPIKeys, func(k models.APIKey) int64 { return k.Id })
+	if err != nil {
+		return err
+	}
+
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: keys, Next: next})
+}
+
+func (s *APIServer) CreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("invalid request body")
+	}
+
+	issued, err := s.IssueAPIKey(r.Context(), req.Name, req.Owner, req.Role, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		s.audit(r, "", models.AuditKeyIssue, req.Name, models.OutcomeFailure, err.Error())
+		return err
+	}
+	s.audit(r, "", models.AuditKeyIssue, fmt.Sprintf("api_key:%d", issued.Id), models.OutcomeSuccess, "role "+issued.Role)
+
+	return ResponseJSON(w, http.StatusCreated, APIResponse{Status: http.StatusCreated, Message: "Success", Data: issued})
+}
+
+func (s *APIServer) RevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid api key id")
+	}
+
+	target := fmt.Sprintf("api_key:%d", id)
+	if err := s.db(r.Context()).RevokeAPIKey(id); err != nil {
+		s.audit(r, "", models.AuditKeyRevoke, target, models.OutcomeFailure, err.Error())
+		if strings.Contains(err.Error(), "empty row") {
+			status := http.StatusNotFound
+			return ResponseJSON(w, status, APIResponse{Status: status, Message: "API key not found"})
+		}
+		return err
+	}
+	s.audit(r, "", models.AuditKeyRevoke, target, models.OutcomeSuccess, "")
+
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success"})
+}
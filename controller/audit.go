@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/waiwen1001/bike/middleware"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/utils"
+)
+
+var auditOutcomes = []string{models.OutcomeSuccess, models.OutcomeFailure, models.OutcomeDenied}
+
+// RecordAudit store the event, a failed insert is logged and does not fail the request
+func (s *APIServer) RecordAudit(ctx context.Context, e models.AuditEvent) {
+	e.Truncate()
+	if err := s.db(ctx).CreateAuditEvent(&e); err != nil {
+		slog.ErrorContext(ctx, "Error recording audit event", "action", e.Action, "err", err)
+	}
+}
+
+// audit record an event of the request, actor default to the authorised caller
+func (s *APIServer) audit(r *http.Request, actor string, action string, target string, outcome string, detail string) {
+	if actor == "" {
+		if p, ok := middleware.PrincipalFromContext(r.Context()); ok {
+			actor = p.Subject
+		}
+	}
+
+	s.RecordAudit(r.Context(), models.AuditEvent{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		IP:        middleware.ClientIP(r, s.trustProxy),
+		UserAgent: r.UserAgent(),
+		Outcome:   outcome,
+		Detail:    detail,
+	})
+}
+
+// auditReject record credential rejected by the auth middleware
+func (s *APIServer) auditReject(r *http.Request, status int, actor string, reason string) {
+	action, outcome := models.AuditAuthRejected, models.OutcomeFailure
+	if status == http.StatusForbidden {
+		action, outcome = models.AuditAuthForbidden, models.OutcomeDenied
+	}
+	s.audit(r, actor, action, r.Method+" "+r.URL.Path, outcome, reason)
+}
+
+func parseAuditFilter(r *http.Request) (models.AuditFilter, error) {
+	q := r.URL.Query()
+	filter := models.AuditFilter{
+		Actor:   q.Get("actor"),
+		Action:  q.Get("action"),
+		Target:  q.Get("target"),
+		Outcome: q.Get("outcome"),
+	}
+
+	if filter.Outcome != "" && !slices.Contains(auditOutcomes, filter.Outcome) {
+		return filter, fmt.Errorf("outcome must be success, failure or denied")
+	}
+
+	for key, dst := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := q.Get(key); v != "" {
+			t, err := utils.ParseTime(v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %v time format", key)
+			}
+			*dst = &t
+		}
+	}
+
+	if filter.From != nil && filter.To != nil && !filter.From.Before(*filter.To) {
+		return filter, fmt.Errorf("from must be before to")
+	}
+	return filter, nil
+}
+
+// GetAuditEvents list newest events first, filtered by actor, action, target, outcome and from/to time
+func (s *APIServer) GetAuditEvents(w http.ResponseWriter, r *http.Request) error {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		return err
+	}
+
+	page, _, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+
+	events, next, err := fetchPage(r, "", page, func(page models.Page) ([]models.AuditEvent, error) {
+		return s.db(r.Context()).GetAuditEvents(filter, page)
+	}, func(e models.AuditEvent) int64 { return e.Id })
+	if err != nil {
+		return err
+	}
+
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: events, Next: next})
+}
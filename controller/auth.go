@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/waiwen1001/bike/middleware"
+	"github.com/waiwen1001/bike/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = middleware.SessionCookieName
+	minPasswordLength = 8
+)
+
+// dummyHash is compared when username does not exist so unknown and known users take the same time
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateUser hash the password and store the user, used by create-user command
+func (s *APIServer) CreateUser(ctx context.Context, username string, password string, role string) (models.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return models.User{}, fmt.Errorf("username cannot be empty")
+	}
+	if !models.ValidRole(role) {
+		return models.User{}, fmt.Errorf("role must be one of %v", strings.Join(models.Roles, ", "))
+	}
+	if len(password) < minPasswordLength {
+		return models.User{}, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	u := models.User{Username: username, Role: role, PasswordHash: string(hash)}
+	if err := s.db(ctx).CreateUser(&u); err != nil {
+		return models.User{}, err
+	}
+	return u, nil
+}
+
+func (s *APIServer) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	maxAge := int(time.Until(expires).Seconds())
+	if token == "" {
+		maxAge = -1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.secureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startSession store a new session of the user and set its cookie
+func (s *APIServer) startSession(ctx context.Context, w http.ResponseWriter, u models.User) error {
+	token, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+
+	sess := models.Session{Token: token, UserId: u.Id, ExpiresAt: time.Now().Add(s.sessionTTL)}
+	if err := s.db(ctx).CreateSession(&sess); err != nil {
+		return err
+	}
+
+	s.setSessionCookie(w, token, sess.ExpiresAt)
+	return nil
+}
+
+// sessionUser return the user of the request session cookie
+func (s *APIServer) sessionUser(r *http.Request) (models.User, bool) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return models.User{}, false
+	}
+
+	u, err := s.db(r.Context()).GetSessionUser(c.Value)
+	if err != nil {
+		if !strings.Contains(err.Error(), "empty row") {
+			slog.ErrorContext(r.Context(), "Error getting session user", "err", err)
+		}
+		return models.User{}, false
+	}
+	return u, true
+}
+
+func (s *APIServer) CheckAuth(w http.ResponseWriter, r *http.Request) error {
+	if u, ok := s.sessionUser(r); ok {
+		return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Authorized", Data: u})
+	}
+	return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Unauthorized"})
+}
+
+func (s *APIServer) Login(w http.ResponseWriter, r *http.Request) error {
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	u, err := s.db(r.Context()).GetUserByUsername(username)
+	if err != nil && !strings.Contains(err.Error(), "empty row") {
+		return err
+	}
+
+	hash := dummyHash
+	if err == nil {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || err != nil {
+		s.audit(r, "user:"+username, models.AuditLogin, "password", models.OutcomeFailure, "invalid username or password")
+		return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Login failed"})
+	}
+
+	if err := s.startSession(r.Context(), w, u); err != nil {
+		return err
+	}
+	s.audit(r, "user:"+u.Username, models.AuditLogin, "password", models.OutcomeSuccess, "")
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: u})
+}
+
+// Logout end only the session of the request, other sessions of the same user stay valid
+func (s *APIServer) Logout(w http.ResponseWriter, r *http.Request) error {
+	if u, ok := s.sessionUser(r); ok {
+		s.audit(r, "user:"+u.Username, models.AuditLogout, "session", models.OutcomeSuccess, "")
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil && c.Value != "" {
+		if err := s.db(r.Context()).DeleteSession(c.Value); err != nil {
+			return err
+		}
+	}
+
+	s.setSessionCookie(w, "", time.Unix(0, 0))
+
+	// frontend navigate to logoutUrl to end the identity provider session
+	var data any
+	if s.oidc != nil && s.oidc.init(r.Context()) == nil {
+		data = map[string]string{"logoutUrl": s.oidc.logoutUrl()}
+	}
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: data})
+}
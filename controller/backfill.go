@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/waiwen1001/bike/metrics"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
+	"github.com/waiwen1001/bike/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BackfillWeather store historical weather of every station grid cell for each snapshot between from and to.
+// Cells already stored for a snapshot are skipped so an interrupted run can simply be started again.
+func (s *APIServer) BackfillWeather(ctx context.Context, from string, to string, provider weather.HistoricalProvider) (int, error) {
+	snapshots, err := s.db(ctx).GetSnapshotTimes(from, to)
+	if err != nil {
+		return 0, err
+	}
+	slog.InfoContext(ctx, "Weather backfill", "snapshots", len(snapshots), "from", from, "to", to, "provider", provider.Name())
+
+	// snapshots are sorted, only keep reports of the current hour so cells are fetched once per hour
+	hour := ""
+	hourly := make(map[string]models.WeatherReport)
+	total := 0
+	for i, at := range snapshots {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		t, err := time.Parse("2006-01-02 15:04:05", at)
+		if err != nil {
+			return total, err
+		}
+		if h := t.Truncate(time.Hour).Format("2006-01-02 15"); h != hour {
+			hour = h
+			hourly = make(map[string]models.WeatherReport)
+		}
+
+		existing, err := s.db(ctx).GetWeatherCells(at)
+		if err != nil {
+			return total, err
+		}
+
+		positions, err := s.db(ctx).GetStationPositions(at)
+		if err != nil {
+			return total, err
+		}
+
+		var obs []models.WeatherObservation
+		seen := make(map[string]bool)
+		for _, p := range positions {
+			key, lat, lng := s.weather.cell(stationPosition(p))
+			if existing[key] || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			report, ok := hourly[key]
+			if !ok {
+				report, err = historicalWeather(ctx, provider, lat, lng, t)
+				metrics.WeatherCalls.WithLabelValues(provider.Name(), "historical", metrics.Outcome(err)).Inc()
+				if err != nil {
+					if ctx.Err() != nil {
+						return total, ctx.Err()
+					}
+					slog.WarnContext(ctx, "Error fetching historical weather", "cell", key, "at", at, "err", err)
+					continue
+				}
+				hourly[key] = report
+			}
+
+			obs = append(obs, models.WeatherObservation{Cell: key, Latitude: lat, Longitude: lng, ObservedAt: report.ObservedAt, Report: report})
+		}
+
+		if err := s.db(ctx).StoreWeatherObservations(at, obs); err != nil {
+			return total, fmt.Errorf("failed to store weather of snapshot %v: %v", at, err)
+		}
+
+		total += len(obs)
+		slog.InfoContext(ctx, "Weather backfill snapshot", "at", at, "n", i+1, "of", len(snapshots), "stored", len(obs), "skipped", len(existing))
+	}
+
+	return total, nil
+}
+
+// historicalWeather call the provider in a span, one per cell missing in the hourly report
+func historicalWeather(ctx context.Context, provider weather.HistoricalProvider, latitude float64, longitude float64, at time.Time) (models.WeatherReport, error) {
+	ctx, span := tracing.Start(ctx, "weather.historical", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("weather.provider", provider.Name()),
+		attribute.Float64("weather.latitude", latitude),
+		attribute.Float64("weather.longitude", longitude),
+		attribute.String("weather.at", at.Format(time.RFC3339)),
+	))
+	report, err := provider.Historical(ctx, latitude, longitude, at)
+	tracing.End(span, err)
+	return report, err
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/utils"
+)
+
+// flush response every n rows so client start receiving data early
+const exportFlushRows = 500
+
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// ParseTimeRange parse from and to into db timestamp format, shared by api and cli commands
+func ParseTimeRange(from string, to string) (string, string, error) {
+	if from == "" || to == "" {
+		return "", "", fmt.Errorf("from and to cannot be empty")
+	}
+
+	f, err := utils.ParseTime(from)
+	if err != nil {
+		return "", "", err
+	}
+
+	t, err := utils.ParseTime(to)
+	if err != nil {
+		return "", "", err
+	}
+
+	if t.Before(f) {
+		return "", "", fmt.Errorf("to must be after from")
+	}
+
+	return f.Format("2006-01-02 15:04:05.000"), t.Format("2006-01-02 15:04:05.999"), nil
+}
+
+func (s *APIServer) Export(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	from, to, err := ParseTimeRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: err.Error()})
+	}
+
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: fmt.Sprintf("invalid format: %s", format)})
+	}
+
+	// large export can take longer than the server write timeout
+	clearDeadlines(w)
+	// header is sent before the writer is created, parquet writer write the file magic at once
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"export.%v\"", format))
+	w.WriteHeader(http.StatusOK)
+
+	ew, err := models.NewExportWriter(w, format, q.Get("bikes") == "true")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Export error", "rows", 0, "err", err)
+		return nil
+	}
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err = s.db(r.Context()).ExportStations(from, to, nil, q.Get("bikes") == "true", func(row models.ExportRow) error {
+		if err := ew.Write(row); err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushRows == 0 && flusher != nil {
+			if err := ew.Flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	// header already sent, can only log the error here
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Export error", "rows", count, "err", err)
+	}
+	if err := ew.Close(); err != nil {
+		slog.ErrorContext(r.Context(), "Export flush error", "err", err)
+	}
+
+	slog.InfoContext(r.Context(), "Exported rows", "rows", count, "duration", time.Since(now))
+	return nil
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/waiwen1001/bike/models"
+)
+
+const geoJSONContentType = "application/geo+json"
+
+// wantsGeoJSON check format=geojson query or Accept: application/geo+json header
+func wantsGeoJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "geojson" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), geoJSONContentType)
+}
+
+func ResponseGeoJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Add("Content-Type", geoJSONContentType)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// toFeatureCollection flatten weather and snapshot time into each feature properties so map libraries can load it directly
+func toFeatureCollection(data []models.BikeResult, next string) models.FeatureCollection {
+	fc := models.FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []models.GeoFeature{},
+		Next:     next,
+	}
+
+	for _, v := range data {
+		fc.Features = append(fc.Features, models.GeoFeature{
+			Type:     "Feature",
+			Geometry: v.Stations.Geometry,
+			Properties: models.GeoProperties{
+				Properties:  v.Stations.Properties,
+				StationType: v.Stations.Type,
+				At:          v.At,
+				Weather:     v.Weather,
+			},
+		})
+	}
+
+	return fc
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/utils"
+)
+
+const readyCheckTimeout = 2 * time.Second
+
+// ReadyCheck is the result of one readiness check
+type ReadyCheck struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	Modified  bool   `json:"modified"`
+}
+
+// Healthz only tell the process is serving, it does not touch the database
+func (s *APIServer) Healthz(w http.ResponseWriter, r *http.Request) error {
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "OK"})
+}
+
+func (s *APIServer) readyChecks(ctx context.Context) map[string]ReadyCheck {
+	checks := map[string]ReadyCheck{}
+
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	if err := s.db(ctx).Ping(ctx); err != nil {
+		checks["database"] = ReadyCheck{Message: err.Error()}
+		return checks
+	}
+	checks["database"] = ReadyCheck{Ok: true}
+
+	// newer schema is fine, it is migrated by a newer instance during rolling deploy
+	version, err := s.db(ctx).GetSchemaVersion()
+	switch {
+	case err != nil:
+		checks["migrations"] = ReadyCheck{Message: err.Error()}
+	case version < models.SchemaVersion:
+		checks["migrations"] = ReadyCheck{Message: fmt.Sprintf("schema version %d, want %d", version, models.SchemaVersion)}
+	default:
+		checks["migrations"] = ReadyCheck{Ok: true}
+	}
+
+	checks["ingest"] = s.ingestCheck(ctx)
+	return checks
+}
+
+// ingestCheck compare the latest stored snapshot with the max age, empty database is ready so the first ingest can run
+func (s *APIServer) ingestCheck(ctx context.Context) ReadyCheck {
+	if s.serverConfig.ReadyMaxIngestAge == 0 {
+		return ReadyCheck{Ok: true, Message: "disabled"}
+	}
+
+	at, err := s.db(ctx).GetLastUpdated()
+	if err != nil {
+		return ReadyCheck{Message: err.Error()}
+	}
+	if at == "" {
+		return ReadyCheck{Ok: true, Message: "no snapshot stored yet"}
+	}
+
+	t, err := utils.ParseTime(at)
+	if err != nil {
+		return ReadyCheck{Message: err.Error()}
+	}
+
+	age := time.Since(t).Truncate(time.Second)
+	if age > s.serverConfig.ReadyMaxIngestAge {
+		return ReadyCheck{Message: fmt.Sprintf("latest snapshot %v is %v old", at, age)}
+	}
+	return ReadyCheck{Ok: true, Message: fmt.Sprintf("latest snapshot %v", at)}
+}
+
+// Readyz return 503 when the database is unreachable, not migrated or the last ingest is too old
+func (s *APIServer) Readyz(w http.ResponseWriter, r *http.Request) error {
+	checks := s.readyChecks(r.Context())
+	for _, c := range checks {
+		if !c.Ok {
+			status := http.StatusServiceUnavailable
+			return ResponseJSON(w, status, APIResponse{Status: status, Message: "Not ready", Data: checks})
+		}
+	}
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Ready", Data: checks})
+}
+
+func buildVersion() VersionInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return VersionInfo{Version: "unknown"}
+	}
+
+	v := VersionInfo{Version: info.Main.Version, GoVersion: info.GoVersion}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			v.Revision = setting.Value
+		case "vcs.time":
+			v.BuildTime = setting.Value
+		case "vcs.modified":
+			v.Modified = setting.Value == "true"
+		}
+	}
+	return v
+}
+
+func (s *APIServer) Version(w http.ResponseWriter, r *http.Request) error {
+	return ResponseJSON(w, http.StatusOK, APIResponse{Status: http.StatusOK, Message: "Success", Data: buildVersion()})
+}
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/models"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCookieName = "bike_oidc"
+	// time allowed between login redirect and callback
+	oidcStateTTL = 10 * time.Minute
+)
+
+// OIDCAuth run the authorization code flow against Auth0 or any OIDC provider,
+// provider discovery is done on first login so startup does not depend on the provider
+type OIDCAuth struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	callbackUrl  string
+	// frontend url to return after login and logout
+	redirectUrl string
+
+	mu         sync.Mutex
+	verifier   *oidc.IDTokenVerifier
+	config     oauth2.Config
+	endSession string
+}
+
+// NewOIDCAuthFromConfig return nil when domain or client id is not set, redirect default to defaultRedirect
+func NewOIDCAuthFromConfig(c config.OIDC, defaultRedirect string) *OIDCAuth {
+	if c.Domain == "" || c.ClientId == "" {
+		return nil
+	}
+
+	redirectUrl := c.RedirectUrl
+	if redirectUrl == "" {
+		redirectUrl = defaultRedirect
+	}
+
+	return NewOIDCAuth(c.Domain, c.ClientId, c.ClientSecret, c.CallbackUrl, redirectUrl)
+}
+
+// NewOIDCAuth accept an Auth0 domain (eg. tenant.auth0.com) or a full issuer url
+func NewOIDCAuth(domain string, clientId string, clientSecret string, callbackUrl string, redirectUrl string) *OIDCAuth {
+	issuer := domain
+	if !strings.HasPrefix(issuer, "http://") && !strings.HasPrefix(issuer, "https://") {
+		// auth0 issuer has trailing slash
+		issuer = "https://" + strings.TrimSuffix(domain, "/") + "/"
+	}
+
+	return &OIDCAuth{
+		issuer:       issuer,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		callbackUrl:  callbackUrl,
+		redirectUrl:  redirectUrl,
+	}
+}
+
+func (o *OIDCAuth) init(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.verifier != nil {
+		return nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, o.issuer)
+	if err != nil {
+		return fmt.Errorf("oidc discovery failed: %v", err)
+	}
+
+	var claims struct {
+		EndSession string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return err
+	}
+
+	o.endSession = claims.EndSession
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.clientId})
+	o.config = oauth2.Config{
+		ClientID:     o.clientId,
+		ClientSecret: o.clientSecret,
+		RedirectURL:  o.callbackUrl,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+	return nil
+}
+
+// logoutUrl end the provider session too, auth0 without end_session_endpoint use /v2/logout
+func (o *OIDCAuth) logoutUrl() string {
+	q := url.Values{"client_id": {o.clientId}}
+	if o.endSession != "" {
+		q.Set("post_logout_redirect_uri", o.redirectUrl)
+		return o.endSession + "?" + q.Encode()
+	}
+
+	q.Set("returnTo", o.redirectUrl)
+	return strings.TrimSuffix(o.issuer, "/") + "/v2/logout?" + q.Encode()
+}
+
+func (s *APIServer) setOIDCCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     "/api/v1",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCLogin redirect to the provider login page, state nonce and pkce verifier are kept in a short lived cookie
+func (s *APIServer) OIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	if s.oidc == nil {
+		status := http.StatusNotFound
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "OIDC login is not configured"})
+	}
+
+	if err := s.oidc.init(r.Context()); err != nil {
+		return err
+	}
+
+	state, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	nonce, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	s.setOIDCCookie(w, strings.Join([]string{state, nonce, verifier}, "."), oidcStateTTL)
+	authUrl := s.oidc.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authUrl, http.StatusFound)
+	return nil
+}
+
+// OIDCCallback exchange the code, verify the id token signature against the provider JWKS and start a local session
+func (s *APIServer) OIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	if s.oidc == nil {
+		status := http.StatusNotFound
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "OIDC login is not configured"})
+	}
+
+	if err := s.oidc.init(r.Context()); err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: fmt.Sprintf("Login failed: %v", e)})
+	}
+
+	c, err := r.Cookie(oidcCookieName)
+	parts := []string{}
+	if err == nil {
+		parts = strings.Split(c.Value, ".")
+	}
+	s.setOIDCCookie(w, "", -time.Second)
+	if len(parts) != 3 || q.Get("state") == "" || q.Get("state") != parts[0] {
+		status := http.StatusBadRequest
+		return ResponseJSON(w, status, APIResponse{Status: status, Message: "Invalid login state"})
+	}
+	nonce, verifier := parts[1], parts[2]
+
+	token, err := s.oidc.config.Exchange(r.Context(), q.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC code exchange error", "err", err)
+		s.audit(r, "", models.AuditLogin, "oidc", models.OutcomeFailure, "code exchange failed")
+		return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Login failed"})
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Login failed"})
+	}
+
+	idToken, err := s.oidc.verifier.Verify(r.Context(), rawIdToken)
+	if err == nil && idToken.Nonce != nonce {
+		err = fmt.Errorf("nonce mismatch")
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC id token verify error", "err", err)
+		s.audit(r, "", models.AuditLogin, "oidc", models.OutcomeFailure, err.Error())
+		return ResponseJSON(w, http.StatusUnauthorized, APIResponse{Status: http.StatusUnauthorized, Message: "Login failed"})
+	}
+
+	var claims struct {
+		Email    string `json:"email"`
+		Nickname string `json:"nickname"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return err
+	}
+
+	username := claims.Email
+	if username == "" {
+		username = claims.Nickname
+	}
+	if username == "" {
+		username = idToken.Subject
+	}
+
+	u, err := s.db(r.Context()).UpsertOIDCUser(idToken.Subject, username)
+	if err != nil {
+		return err
+	}
+
+	if err := s.startSession(r.Context(), w, u); err != nil {
+		return err
+	}
+	s.audit(r, "user:"+u.Username, models.AuditLogin, "oidc", models.OutcomeSuccess, "")
+
+	http.Redirect(w, r, s.oidc.redirectUrl, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,594 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/waiwen1001/bike/middleware"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/utils"
+)
+
+// memStation is one station row of a snapshot
+type memStation struct {
+	At string
+	models.Properties
+}
+
+// memStore is the in-memory models.Storage shared by the tests, it implement every method
+// so a test never call into a nil store. Bikes are not kept, bike export return no rows.
+type memStore struct {
+	mu sync.Mutex
+
+	stations     []memStation
+	observations []models.WeatherObservation
+
+	rules      []models.AlertRule
+	states     map[int64]map[int64]models.AlertState
+	deliveries []models.AlertDelivery
+
+	users    []models.User
+	oidc     map[string]int64
+	sessions map[string]models.Session
+
+	keys    []models.APIKey
+	touched map[int64]bool
+	limits  *middleware.MemoryRateLimitStore
+
+	events []models.AuditEvent
+
+	pingErr error
+	version int
+}
+
+var _ models.Storage = (*memStore)(nil)
+
+func newMemStore() *memStore {
+	return &memStore{
+		states:   make(map[int64]map[int64]models.AlertState),
+		oidc:     make(map[string]int64),
+		sessions: make(map[string]models.Session),
+		touched:  make(map[int64]bool),
+		limits:   middleware.NewMemoryRateLimitStore(),
+		version:  models.SchemaVersion,
+	}
+}
+
+// addSnapshot store stations of the snapshot at, in "2006-01-02 15:04:05" format
+func (m *memStore) addSnapshot(at string, stations ...models.Properties) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range stations {
+		m.stations = append(m.stations, memStation{At: at, Properties: p})
+	}
+}
+
+// addSession create the user and a session of token, like a login
+func (m *memStore) addSession(token string, user models.User) {
+	m.CreateUser(&user)
+	m.CreateSession(&models.Session{Token: token, UserId: user.Id, ExpiresAt: time.Now().Add(time.Hour)})
+}
+
+// inRange compare db timestamps, from and to may have milliseconds
+func inRange(at string, from string, to string) bool {
+	return at >= from[:min(len(from), len(at))] && at <= to
+}
+
+func (m *memStore) StoreIndegoData(data *models.IndegoRes) error {
+	t, err := utils.ParseTime(data.LastUpdated)
+	if err != nil {
+		return err
+	}
+
+	stations := []models.Properties{}
+	for _, f := range data.Features {
+		p := f.Properties
+		if len(f.Geometry.Coordinates) == 2 {
+			p.Longitude, p.Latitude = f.Geometry.Coordinates[0], f.Geometry.Coordinates[1]
+		}
+		stations = append(stations, p)
+	}
+	m.addSnapshot(t.Format("2006-01-02 15:04:05"), stations...)
+	return nil
+}
+
+func (m *memStore) GetStationList(at string, page models.Page) ([]models.BikeResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []models.BikeResult{}
+	for _, st := range m.stations {
+		if st.At != at || st.Id <= page.AfterId {
+			continue
+		}
+		if page.Limit > 0 && len(res) >= page.Limit {
+			break
+		}
+		res = append(res, models.BikeResult{At: at, Stations: models.Feature{Type: "Feature", Properties: st.Properties}})
+	}
+	return res, nil
+}
+
+func (m *memStore) GetStation(at string, kioskId string) (models.BikeResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, st := range m.stations {
+		if st.At == at && strconv.FormatInt(st.KioskId, 10) == kioskId {
+			return models.BikeResult{At: at, Stations: models.Feature{Type: "Feature", Properties: st.Properties}}, nil
+		}
+	}
+	return models.BikeResult{}, fmt.Errorf("empty row")
+}
+
+func (m *memStore) ExportStations(from string, to string, kioskId *int64, withBikes bool, fn func(models.ExportRow) error) error {
+	m.mu.Lock()
+	rows := []models.ExportStation{}
+	for _, st := range m.stations {
+		if withBikes || !inRange(st.At, from, to) || kioskId != nil && st.KioskId != *kioskId {
+			continue
+		}
+		rows = append(rows, models.ExportStation{UpdatedAt: st.At, Id: st.Id, KioskId: st.KioskId, Name: st.Name, Latitude: st.Latitude, Longitude: st.Longitude,
+			TotalDocks: st.TotalDocks, DocksAvailable: st.DocksAvailable, BikesAvailable: st.BikesAvailable, KioskStatus: st.KioskStatus, KioskPublicStatus: st.KioskPublicStatus})
+	}
+	m.mu.Unlock()
+
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memStore) GetLastUpdated() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	last := ""
+	for _, st := range m.stations {
+		last = max(last, st.At)
+	}
+	return last, nil
+}
+
+func (m *memStore) DeleteSnapshotsBefore(before string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := []memStation{}
+	for _, st := range m.stations {
+		if st.At >= before {
+			kept = append(kept, st)
+		}
+	}
+	deleted := int64(len(m.stations) - len(kept))
+	m.stations = kept
+	return deleted, nil
+}
+
+func (m *memStore) StoreWeatherObservations(at string, obs []models.WeatherObservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, o := range obs {
+		o.SnapshotAt = at
+		replaced := false
+		for i, stored := range m.observations {
+			if stored.SnapshotAt == at && stored.Cell == o.Cell {
+				m.observations[i], replaced = o, true
+			}
+		}
+		if !replaced {
+			m.observations = append(m.observations, o)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) GetNearestWeather(at string, cells []string) (map[string]models.WeatherObservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := utils.ParseTime(at)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]models.WeatherObservation)
+	nearest := make(map[string]float64)
+	for _, cell := range cells {
+		for _, o := range m.observations {
+			ot, err := utils.ParseTime(o.SnapshotAt)
+			if err != nil || o.Cell != cell {
+				continue
+			}
+			diff := math.Abs(ot.Sub(t).Seconds())
+			if diff > models.WeatherMatchWindow.Seconds() {
+				continue
+			}
+			if d, ok := nearest[cell]; !ok || diff < d {
+				nearest[cell] = diff
+				res[cell] = o
+			}
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) GetSnapshotTimes(from string, to string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool)
+	times := []string{}
+	for _, st := range m.stations {
+		if inRange(st.At, from, to) && !seen[st.At] {
+			seen[st.At] = true
+			times = append(times, st.At)
+		}
+	}
+	sort.Strings(times)
+	return times, nil
+}
+
+func (m *memStore) GetStationPositions(at string) ([]models.Properties, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []models.Properties{}
+	for _, st := range m.stations {
+		if st.At == at {
+			res = append(res, models.Properties{KioskId: st.KioskId, Latitude: st.Latitude, Longitude: st.Longitude})
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) GetWeatherCells(at string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cells := make(map[string]bool)
+	for _, o := range m.observations {
+		if o.SnapshotAt == at {
+			cells[o.Cell] = true
+		}
+	}
+	return cells, nil
+}
+
+func (m *memStore) GetWeatherObservations(from string, to string) ([]models.WeatherObservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []models.WeatherObservation{}
+	for _, o := range m.observations {
+		if inRange(o.SnapshotAt, from, to) {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) CreateAlertRule(a *models.AlertRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a.Id = int64(len(m.rules) + 1)
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = a.CreatedAt
+	m.rules = append(m.rules, *a)
+	return nil
+}
+
+func (m *memStore) GetAlertRules(page models.Page) ([]models.AlertRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules := []models.AlertRule{}
+	for _, rule := range m.rules {
+		if rule.Id > page.AfterId && (page.Limit == 0 || len(rules) < page.Limit) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (m *memStore) GetAlertRule(id int64) (models.AlertRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rule := range m.rules {
+		if rule.Id == id {
+			return rule, nil
+		}
+	}
+	return models.AlertRule{}, fmt.Errorf("empty row")
+}
+
+func (m *memStore) UpdateAlertRule(a *models.AlertRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, rule := range m.rules {
+		if rule.Id == a.Id {
+			a.UpdatedAt = time.Now()
+			m.rules[i] = *a
+			return nil
+		}
+	}
+	return fmt.Errorf("empty row")
+}
+
+func (m *memStore) DeleteAlertRule(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, rule := range m.rules {
+		if rule.Id == id {
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			delete(m.states, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("empty row")
+}
+
+func (m *memStore) GetAlertStates(ruleId int64) (map[int64]models.AlertState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make(map[int64]models.AlertState)
+	for kioskId, state := range m.states[ruleId] {
+		states[kioskId] = state
+	}
+	return states, nil
+}
+
+func (m *memStore) SaveAlertState(state models.AlertState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.states[state.RuleId] == nil {
+		m.states[state.RuleId] = make(map[int64]models.AlertState)
+	}
+	m.states[state.RuleId][state.KioskId] = state
+	return nil
+}
+
+func (m *memStore) DeleteAlertState(ruleId int64, kioskId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.states[ruleId], kioskId)
+	return nil
+}
+
+func (m *memStore) CreateAlertDelivery(d *models.AlertDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d.Id = int64(len(m.deliveries) + 1)
+	m.deliveries = append(m.deliveries, *d)
+	return nil
+}
+
+func (m *memStore) UpdateAlertDelivery(d *models.AlertDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d.Id < 1 || d.Id > int64(len(m.deliveries)) {
+		return fmt.Errorf("empty row")
+	}
+	m.deliveries[d.Id-1] = *d
+	return nil
+}
+
+// GetAlertDeliveries return newest first like the database
+func (m *memStore) GetAlertDeliveries(ruleId int64, page models.Page) ([]models.AlertDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []models.AlertDelivery{}
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < page.Limit; i-- {
+		d := m.deliveries[i]
+		if d.RuleId == ruleId && (page.AfterId == 0 || d.Id < page.AfterId) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *memStore) CreateUser(user *models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Username == user.Username {
+			return fmt.Errorf("failed to insert user: duplicate username")
+		}
+	}
+	user.Id = int64(len(m.users) + 1)
+	user.CreatedAt = time.Now()
+	m.users = append(m.users, *user)
+	return nil
+}
+
+func (m *memStore) GetUserByUsername(username string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return models.User{}, fmt.Errorf("empty row")
+}
+
+// UpsertOIDCUser create a viewer on first login of subject, later logins update the username
+func (m *memStore) UpsertOIDCUser(subject string, username string) (models.User, error) {
+	m.mu.Lock()
+	if id, ok := m.oidc[subject]; ok {
+		defer m.mu.Unlock()
+		m.users[id-1].Username = username
+		return m.users[id-1], nil
+	}
+	m.mu.Unlock()
+
+	user := models.User{Username: username, Role: models.RoleViewer}
+	if err := m.CreateUser(&user); err != nil {
+		return user, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oidc[subject] = user.Id
+	return user, nil
+}
+
+func (m *memStore) CreateSession(sess *models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess.CreatedAt = time.Now()
+	m.sessions[models.HashToken(sess.Token)] = *sess
+	return nil
+}
+
+func (m *memStore) GetSessionUser(token string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sess, ok := m.sessions[models.HashToken(token)]
+	if ok && time.Now().Before(sess.ExpiresAt) && sess.UserId <= int64(len(m.users)) {
+		return m.users[sess.UserId-1], nil
+	}
+	return models.User{}, fmt.Errorf("empty row")
+}
+
+func (m *memStore) DeleteSession(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, models.HashToken(token))
+	return nil
+}
+
+func (m *memStore) CreateAPIKey(key *models.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key.Id = int64(len(m.keys) + 1)
+	m.keys = append(m.keys, *key)
+	return nil
+}
+
+func (m *memStore) GetAPIKeys(page models.Page) ([]models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := []models.APIKey{}
+	for _, key := range m.keys {
+		if key.Id > page.AfterId && len(keys) < page.Limit {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memStore) GetAPIKeyByHash(hash string) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.keys {
+		if key.KeyHash == hash {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, fmt.Errorf("empty row")
+}
+
+func (m *memStore) TouchAPIKey(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.touched[id] = true
+	return nil
+}
+
+func (m *memStore) RevokeAPIKey(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id < 1 || id > int64(len(m.keys)) {
+		return fmt.Errorf("empty row")
+	}
+	now := time.Now()
+	m.keys[id-1].RevokedAt = &now
+	return nil
+}
+
+func (m *memStore) TakeRateLimitToken(key string, rate float64, burst int) (float64, bool, error) {
+	return m.limits.TakeRateLimitToken(key, rate, burst)
+}
+
+func (m *memStore) PruneRateLimits() error {
+	return nil
+}
+
+func (m *memStore) CreateAuditEvent(e *models.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	e.Id = int64(len(m.events) + 1)
+	m.events = append(m.events, *e)
+	return nil
+}
+
+// GetAuditEvents return newest events first like the database
+func (m *memStore) GetAuditEvents(filter models.AuditFilter, page models.Page) ([]models.AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	match := func(want string, v string) bool {
+		return want == "" || want == v
+	}
+
+	events := []models.AuditEvent{}
+	for i := len(m.events) - 1; i >= 0 && len(events) < page.Limit; i-- {
+		e := m.events[i]
+		if page.AfterId > 0 && e.Id >= page.AfterId {
+			continue
+		}
+		if !match(filter.Actor, e.Actor) || !match(filter.Action, e.Action) || !match(filter.Target, e.Target) || !match(filter.Outcome, e.Outcome) {
+			continue
+		}
+		if filter.From != nil && e.At.Before(*filter.From) || filter.To != nil && !e.At.Before(*filter.To) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (m *memStore) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pingErr
+}
+
+func (m *memStore) GetSchemaVersion() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.version, nil
+}
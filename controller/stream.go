@@ -0,0 +1,343 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/waiwen1001/bike/models"
+)
+
+// keep idle connection alive behind proxies
+const streamPingInterval = 30 * time.Second
+
+type Snapshot struct {
+	At       string
+	Features []models.Feature
+}
+
+// StreamMessage is sent to stream clients, first message type is snapshot (full state) then update (changed stations only)
+type StreamMessage struct {
+	Type     string           `json:"type"`
+	At       string           `json:"at"`
+	Stations []models.Feature `json:"stations"`
+}
+
+type StreamFilter struct {
+	KioskIds map[int64]bool
+	// minLon, minLat, maxLon, maxLat
+	BBox []float64
+}
+
+type subscriber struct {
+	filter StreamFilter
+	ch     chan Snapshot
+	last   map[int64]models.Properties
+}
+
+// Hub broadcast new stored snapshot to all stream subscribers
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*subscriber]struct{})}
+}
+
+func (h *Hub) Subscribe(filter StreamFilter) *subscriber {
+	sub := &subscriber{
+		filter: filter,
+		ch:     make(chan Snapshot, 1),
+		last:   make(map[int64]models.Properties),
+	}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+func (h *Hub) Publish(snap Snapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		// slow client only need the newest snapshot, diff is against what it received last
+		select {
+		case <-sub.ch:
+		default:
+		}
+		sub.ch <- snap
+	}
+}
+
+func (f StreamFilter) match(p models.Properties) bool {
+	if len(f.KioskIds) > 0 && !f.KioskIds[p.KioskId] {
+		return false
+	}
+
+	if len(f.BBox) == 4 {
+		lat, lng := stationPosition(p)
+		if lng < f.BBox[0] || lat < f.BBox[1] || lng > f.BBox[2] || lat > f.BBox[3] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func stationChanged(a models.Properties, b models.Properties) bool {
+	if a.BikesAvailable != b.BikesAvailable || a.DocksAvailable != b.DocksAvailable || a.TotalDocks != b.TotalDocks ||
+		a.ClassicBikesAvailable != b.ClassicBikesAvailable || a.SmartBikesAvailable != b.SmartBikesAvailable ||
+		a.ElectricBikesAvailable != b.ElectricBikesAvailable || a.TrikesAvailable != b.TrikesAvailable ||
+		a.KioskStatus != b.KioskStatus || a.KioskPublicStatus != b.KioskPublicStatus || a.KioskConnectionStatus != b.KioskConnectionStatus {
+		return true
+	}
+
+	return false
+}
+
+// diff return stations matching the filter that changed since the last message sent to this subscriber
+func (sub *subscriber) diff(snap Snapshot) []models.Feature {
+	changed := []models.Feature{}
+	for _, f := range snap.Features {
+		p := f.Properties
+		if !sub.filter.match(p) {
+			continue
+		}
+
+		if last, ok := sub.last[p.KioskId]; ok && !stationChanged(last, p) {
+			continue
+		}
+
+		sub.last[p.KioskId] = p
+		changed = append(changed, f)
+	}
+
+	return changed
+}
+
+func parseStreamFilter(r *http.Request) (filter StreamFilter, err error) {
+	if ids := r.URL.Query().Get("kioskIds"); ids != "" {
+		filter.KioskIds = make(map[int64]bool)
+		for _, v := range strings.Split(ids, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid kioskIds: %s", ids)
+			}
+			filter.KioskIds[id] = true
+		}
+	}
+
+	if bbox := r.URL.Query().Get("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return filter, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+		for _, v := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid bbox: %s", bbox)
+			}
+			filter.BBox = append(filter.BBox, n)
+		}
+	}
+
+	return filter, nil
+}
+
+// latestSnapshot load the latest stored snapshot as initial state for new subscriber
+func (s *APIServer) latestSnapshot(ctx context.Context) (Snapshot, error) {
+	at, err := s.db(ctx).GetLastUpdated()
+	if err != nil || at == "" {
+		return Snapshot{}, err
+	}
+
+	data, err := s.db(ctx).GetStationList(at, models.Page{})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	snap := Snapshot{At: at}
+	for _, v := range data {
+		snap.Features = append(snap.Features, v.Stations)
+	}
+
+	return snap, nil
+}
+
+// subscribe register subscriber and return first message with full state filtered
+func (s *APIServer) subscribe(r *http.Request) (*subscriber, StreamMessage, error) {
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		return nil, StreamMessage{}, err
+	}
+
+	// subscribe before loading state so no snapshot stored in between is missed
+	sub := s.hub.Subscribe(filter)
+	snap, err := s.latestSnapshot(r.Context())
+	if err != nil {
+		s.hub.Unsubscribe(sub)
+		return nil, StreamMessage{}, err
+	}
+
+	return sub, StreamMessage{Type: "snapshot", At: snap.At, Stations: sub.diff(snap)}, nil
+}
+
+// clearDeadlines exempt long lived response from the server read and write timeout,
+// recorder in tests does not support deadlines and is left as is
+func clearDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+func (s *APIServer) Stream(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming unsupported")
+	}
+
+	sub, msg, err := s.subscribe(r)
+	if err != nil {
+		return err
+	}
+	defer s.hub.Unsubscribe(sub)
+
+	clearDeadlines(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(msg StreamMessage) error {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", msg.Type, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := send(msg); err != nil {
+		slog.WarnContext(r.Context(), "Stream send error", "err", err)
+		return nil
+	}
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-s.shutdown:
+			return nil
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		case snap := <-sub.ch:
+			changed := sub.diff(snap)
+			if len(changed) == 0 {
+				continue
+			}
+			if err := send(StreamMessage{Type: "update", At: snap.At, Stations: changed}); err != nil {
+				slog.WarnContext(r.Context(), "Stream send error", "err", err)
+				return nil
+			}
+		}
+	}
+}
+
+func (s *APIServer) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// same origins as cors, non browser client send no origin
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || slices.Contains(s.allowedOrigins, origin)
+		},
+	}
+}
+
+func (s *APIServer) StreamWebSocket(w http.ResponseWriter, r *http.Request) error {
+	sub, msg, err := s.subscribe(r)
+	if err != nil {
+		return err
+	}
+	defer s.hub.Unsubscribe(sub)
+
+	// hijacked connection keep the deadlines set by the server
+	clearDeadlines(w)
+	conn, err := s.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader already reply error to client
+		slog.WarnContext(r.Context(), "Websocket upgrade error", "err", err)
+		return nil
+	}
+	defer conn.Close()
+
+	// read loop only to detect client close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := conn.WriteJSON(msg); err != nil {
+		slog.WarnContext(r.Context(), "Websocket send error", "err", err)
+		return nil
+	}
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-s.shutdown:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"), time.Now().Add(time.Second))
+			return nil
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return nil
+			}
+		case snap := <-sub.ch:
+			changed := sub.diff(snap)
+			if len(changed) == 0 {
+				continue
+			}
+			if err := conn.WriteJSON(StreamMessage{Type: "update", At: snap.At, Stations: changed}); err != nil {
+				slog.WarnContext(r.Context(), "Websocket send error", "err", err)
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/waiwen1001/bike/metrics"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// sweep expired entries once cache grow over this size
+	weatherCacheSweepSize = 10000
+	// weather capture deadline of one ingest
+	weatherCaptureTimeout = 2 * time.Minute
+	// snapshot newer than this may fallback to live weather when nothing stored yet
+	weatherLiveWindow = time.Hour
+)
+
+const (
+	WeatherOk          = "ok"
+	WeatherStale       = "stale"
+	WeatherUnavailable = "unavailable"
+)
+
+type weatherFetch func(context.Context, float64, float64) (models.WeatherReport, error)
+
+type weatherEntry struct {
+	weather   models.WeatherReport
+	expiresAt time.Time
+}
+
+// WeatherCache cache weather per grid cell, concurrent lookups of the same cell share one upstream call
+type WeatherCache struct {
+	grid    float64
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]weatherEntry
+	group   singleflight.Group
+}
+
+func NewWeatherCache(grid float64, ttl time.Duration) *WeatherCache {
+	return &WeatherCache{
+		grid:    grid,
+		ttl:     ttl,
+		entries: make(map[string]weatherEntry),
+	}
+}
+
+// cell snap coordinate to the center of its grid cell
+func (c *WeatherCache) cell(latitude float64, longitude float64) (string, float64, float64) {
+	lat := math.Floor(latitude/c.grid)*c.grid + c.grid/2
+	lng := math.Floor(longitude/c.grid)*c.grid + c.grid/2
+	return fmt.Sprintf("%.5f,%.5f", lat, lng), lat, lng
+}
+
+// Get return cached weather of the cell or call fetch with the cell center coordinate.
+// When fetch fail an expired entry is returned with stale true.
+func (c *WeatherCache) Get(ctx context.Context, latitude float64, longitude float64, fetch weatherFetch) (models.WeatherReport, bool, error) {
+	key, lat, lng := c.cell(latitude, longitude)
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expiresAt) {
+		metrics.ObserveWeatherCache("hit")
+		return e.weather, false, nil
+	}
+
+	// caller already left, do not start an upstream call nobody wait for
+	err := ctx.Err()
+	if err == nil {
+		// shared call must not be cancelled by the first caller leaving, each caller wait with its own deadline
+		ch := c.group.DoChan(key, func() (any, error) {
+			w, err := fetch(context.WithoutCancel(ctx), lat, lng)
+			if err != nil {
+				return nil, err
+			}
+
+			c.set(key, w)
+			return w, nil
+		})
+
+		select {
+		case res := <-ch:
+			if res.Err == nil {
+				metrics.ObserveWeatherCache("miss")
+				return res.Val.(models.WeatherReport), false, nil
+			}
+			err = res.Err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if ok {
+		metrics.ObserveWeatherCache("stale")
+		return e.weather, true, nil
+	}
+	metrics.ObserveWeatherCache("miss")
+	return models.WeatherReport{}, false, err
+}
+
+// currentWeather call the provider in a span and count the call by outcome
+func (s *APIServer) currentWeather(ctx context.Context, latitude float64, longitude float64) (models.WeatherReport, error) {
+	ctx, span := tracing.Start(ctx, "weather.current", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("weather.provider", s.weatherProvider.Name()),
+		attribute.Float64("weather.latitude", latitude),
+		attribute.Float64("weather.longitude", longitude),
+	))
+	report, err := s.weatherProvider.Current(ctx, latitude, longitude)
+	tracing.End(span, err)
+	metrics.WeatherCalls.WithLabelValues(s.weatherProvider.Name(), "current", metrics.Outcome(err)).Inc()
+	return report, err
+}
+
+func (c *WeatherCache) set(key string, w models.WeatherReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= weatherCacheSweepSize {
+		for k, e := range c.entries {
+			if now.After(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	c.entries[key] = weatherEntry{weather: w, expiresAt: now.Add(c.ttl)}
+}
+
+// stationPosition return latitude and longitude, upstream feed carry it in coordinates while stored station has latitude and longitude
+func stationPosition(p models.Properties) (float64, float64) {
+	if len(p.Coordinates) == 2 {
+		return p.Coordinates[1], p.Coordinates[0]
+	}
+	return p.Latitude, p.Longitude
+}
+
+type weatherJob struct {
+	key string
+	lat float64
+	lng float64
+}
+
+type weatherResult struct {
+	report models.WeatherReport
+	stale  bool
+	err    error
+}
+
+// fetchWeatherCells fetch weather of each cell with at most weatherParallel workers
+func (s *APIServer) fetchWeatherCells(ctx context.Context, jobs []weatherJob) map[string]weatherResult {
+	results := make(map[string]weatherResult, len(jobs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan weatherJob)
+
+	for i := 0; i < min(s.weatherParallel, len(jobs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range ch {
+				// after the deadline the remaining jobs only get expired cache, without starting upstream calls
+				expired := ctx.Err() != nil
+				report, stale, err := s.weather.Get(ctx, job.lat, job.lng, s.currentWeather)
+				if err != nil && !expired {
+					slog.WarnContext(ctx, "Error fetching weather", "provider", s.weatherProvider.Name(), "cell", job.key, "err", err)
+				}
+
+				mu.Lock()
+				results[job.key] = weatherResult{report: report, stale: stale, err: err}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		ch <- job
+	}
+	close(ch)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		slog.WarnContext(ctx, "Weather deadline reached", "provider", s.weatherProvider.Name(), "cells", len(jobs), "err", err)
+	}
+
+	return results
+}
+
+// CaptureWeather fetch weather once per grid cell of the snapshot and store it, run after each ingest
+func (s *APIServer) CaptureWeather(ctx context.Context, snap Snapshot) {
+	now := time.Now()
+	ctx, span := tracing.Start(ctx, "weather.capture", trace.WithAttributes(attribute.String("snapshot.at", snap.At)))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, weatherCaptureTimeout)
+	defer cancel()
+
+	seen := make(map[string]bool)
+	var jobs []weatherJob
+	for _, f := range snap.Features {
+		key, lat, lng := s.weather.cell(stationPosition(f.Properties))
+		if !seen[key] {
+			seen[key] = true
+			jobs = append(jobs, weatherJob{key: key, lat: lat, lng: lng})
+		}
+	}
+
+	var obs []models.WeatherObservation
+	results := s.fetchWeatherCells(ctx, jobs)
+	for _, job := range jobs {
+		res := results[job.key]
+		// do not store stale cache as observation of this snapshot
+		if res.err != nil || res.stale {
+			continue
+		}
+		obs = append(obs, models.WeatherObservation{Cell: job.key, Latitude: job.lat, Longitude: job.lng, ObservedAt: res.report.ObservedAt, Report: res.report})
+	}
+
+	if err := s.db(ctx).StoreWeatherObservations(snap.At, obs); err != nil {
+		slog.ErrorContext(ctx, "Error storing weather observations", "at", snap.At, "err", err)
+		return
+	}
+
+	slog.InfoContext(ctx, "Captured weather", "at", snap.At, "cells", len(obs), "of", len(jobs), "duration", time.Since(now))
+}
+
+// fillWeather attach stored weather nearest to the snapshot time, recent snapshot without stored weather use live weather.
+// Observation of another snapshot or stale cache is reported as stale, no weather as unavailable.
+func (s *APIServer) fillWeather(ctx context.Context, at string, data []models.BikeResult) {
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.weatherTimeout)
+	defer cancel()
+
+	cellOf := make([]weatherJob, len(data))
+	var cells []string
+	seen := make(map[string]bool)
+	for i, v := range data {
+		key, lat, lng := s.weather.cell(stationPosition(v.Stations.Properties))
+		cellOf[i] = weatherJob{key: key, lat: lat, lng: lng}
+		if !seen[key] {
+			seen[key] = true
+			cells = append(cells, key)
+		}
+	}
+
+	stored, err := s.db(ctx).GetNearestWeather(at, cells)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting stored weather", "at", at, "err", err)
+		stored = map[string]models.WeatherObservation{}
+	}
+	slog.InfoContext(ctx, "Got stored weather", "at", at, "duration", time.Since(now))
+
+	var jobs []weatherJob
+	queued := make(map[string]bool)
+	for i := range data {
+		job := cellOf[i]
+		if o, ok := stored[job.key]; ok {
+			data[i].Weather = o.Report.ToWeather()
+			data[i].WeatherStatus = WeatherOk
+			if o.SnapshotAt != at {
+				data[i].WeatherStatus = WeatherStale
+			}
+			continue
+		}
+
+		data[i].WeatherStatus = WeatherUnavailable
+		if !queued[job.key] {
+			queued[job.key] = true
+			jobs = append(jobs, job)
+		}
+	}
+
+	t, err := time.Parse("2006-01-02 15:04:05", at)
+	if len(jobs) == 0 || err != nil || time.Since(t) > weatherLiveWindow {
+		return
+	}
+
+	now2 := time.Now()
+	results := s.fetchWeatherCells(ctx, jobs)
+	for i := range data {
+		res, ok := results[cellOf[i].key]
+		if !ok || res.err != nil {
+			continue
+		}
+
+		data[i].Weather = res.report.ToWeather()
+		data[i].WeatherStatus = WeatherOk
+		if res.stale {
+			data[i].WeatherStatus = WeatherStale
+		}
+	}
+	slog.InfoContext(ctx, "Fetched weather", "cells", len(jobs), "duration", time.Since(now2))
+}
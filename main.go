@@ -1,27 +1,92 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/waiwen1001/bike/config"
 	"github.com/waiwen1001/bike/controller"
+	"github.com/waiwen1001/bike/logging"
+	"github.com/waiwen1001/bike/metrics"
 	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
 )
 
 func main() {
+	// .env is optional when settings come from the config file or flags
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
-	store, err := models.NewPostgresStore()
+
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	logging.Setup(os.Stderr, cfg.Log)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Error loading postgresql config: %v", err)
+		fatal("Error loading tracing exporter", err)
+	}
+
+	store, err := models.NewPostgresStore(cfg.Database)
+	if err != nil {
+		fatal("Error loading postgresql config", err)
 	}
 
 	if err := store.Init(); err != nil {
-		log.Fatalf("Error loading init db: %v", err)
+		fatal("Error loading init db", err)
+	}
+	metrics.RegisterDB(store.Db)
+
+	if len(args) > 0 {
+		err := runCommand(cfg, store, args)
+		flushTracing(shutdownTracing)
+		if err != nil {
+			fatal("Error running command", err)
+		}
+		return
+	}
+
+	// SIGTERM drain in-flight requests and wait for a running ingestion before closing the pool
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := controller.NewAPIServer(cfg, store)
+	err = server.Run(ctx)
+	flushTracing(shutdownTracing)
+	if closeErr := store.Close(); closeErr != nil {
+		slog.Error("Error closing db", "err", closeErr)
+	}
+	if err != nil {
+		fatal("Error running server", err)
 	}
+}
+
+// flushTracing export spans still batched, the collector may be gone so do not wait long
+func flushTracing(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		slog.Error("Error flushing spans", "err", err)
+	}
+}
 
-	server := controller.NewAPIServer(":3000", store)
-	server.Run()
+// fatal log err with the configured logger and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
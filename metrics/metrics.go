@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bike"
+
+// Registry hold every metric of the api with go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status.",
+	}, []string{"route", "method", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status, stream routes last the whole connection.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	IngestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ingest_duration_seconds",
+		Help:      "Duration of the indego feed fetch and store stages.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"stage"})
+
+	IngestRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_runs_total",
+		Help:      "Indego ingestions by outcome.",
+	}, []string{"outcome"})
+
+	IngestRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_rows_total",
+		Help:      "Rows stored by ingestion, kind is stations or bikes.",
+	}, []string{"kind"})
+
+	WeatherCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "weather_calls_total",
+		Help:      "Weather provider calls by provider, kind (current or historical) and outcome.",
+	}, []string{"provider", "kind", "outcome"})
+
+	WeatherCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "weather_cache_lookups_total",
+		Help:      "Weather cache lookups, result is hit, miss or stale (expired entry served after a failed call).",
+	}, []string{"result"})
+)
+
+// unix nano of the feed last_updated of the latest ingest, 0 before the first one
+var feedUpdated atomic.Int64
+
+// weather cache hits and lookups of the hit ratio gauge
+var cacheHits, cacheLookups atomic.Int64
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration,
+		IngestDuration, IngestRuns, IngestRows,
+		WeatherCalls, WeatherCache,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "feed_staleness_seconds",
+			Help:      "Now minus last_updated of the latest ingested feed, NaN before the first ingest.",
+		}, feedStaleness),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "weather_cache_hit_ratio",
+			Help:      "Weather cache hits over lookups since start, NaN before the first lookup.",
+		}, cacheHitRatio),
+	)
+}
+
+// RegisterDB expose connection pool stats of db
+func RegisterDB(db *sql.DB) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, namespace))
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// SetFeedUpdated record last_updated of the stored feed for the staleness gauge
+func SetFeedUpdated(t time.Time) {
+	feedUpdated.Store(t.UnixNano())
+}
+
+func feedStaleness() float64 {
+	t := feedUpdated.Load()
+	if t == 0 {
+		return math.NaN()
+	}
+	return time.Since(time.Unix(0, t)).Seconds()
+}
+
+// ObserveWeatherCache count a lookup with result hit, miss or stale
+func ObserveWeatherCache(result string) {
+	WeatherCache.WithLabelValues(result).Inc()
+	cacheLookups.Add(1)
+	if result == "hit" {
+		cacheHits.Add(1)
+	}
+}
+
+func cacheHitRatio() float64 {
+	lookups := cacheLookups.Load()
+	if lookups == 0 {
+		return math.NaN()
+	}
+	return float64(cacheHits.Load()) / float64(lookups)
+}
+
+// Outcome label of an error
+func Outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/waiwen1001/bike/config"
+)
+
+const (
+	defaultRolesClaim = "roles"
+	// refetch jwks after this even when every kid is known, to pick up key rotation
+	jwksTTL = time.Hour
+	// minimum time between jwks fetch triggered by unknown kid
+	jwksRefreshInterval = time.Minute
+)
+
+type JWTConfig struct {
+	// HS256Secret enable HS256 tokens when set
+	HS256Secret []byte
+	// JWKSUrl enable RS256 tokens verified with the keys of the url
+	JWKSUrl    string
+	Issuer     string
+	Audience   string
+	RolesClaim string
+}
+
+type JWTAuth struct {
+	config JWTConfig
+	parser *jwt.Parser
+	jwks   *jwksCache
+}
+
+// NewJWTAuthFromConfig return nil when neither secret nor jwks url is set
+func NewJWTAuthFromConfig(c config.JWT) *JWTAuth {
+	return NewJWTAuth(JWTConfig{
+		HS256Secret: []byte(c.HS256Secret),
+		JWKSUrl:     c.JWKSUrl,
+		Issuer:      c.Issuer,
+		Audience:    c.Audience,
+		RolesClaim:  c.RolesClaim,
+	})
+}
+
+func NewJWTAuth(config JWTConfig) *JWTAuth {
+	var methods []string
+	if len(config.HS256Secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if config.JWKSUrl != "" {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+
+	if config.RolesClaim == "" {
+		config.RolesClaim = defaultRolesClaim
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if config.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		opts = append(opts, jwt.WithAudience(config.Audience))
+	}
+
+	return &JWTAuth{
+		config: config,
+		parser: jwt.NewParser(opts...),
+		jwks:   &jwksCache{url: config.JWKSUrl, keys: make(map[string]*rsa.PublicKey)},
+	}
+}
+
+func (j *JWTAuth) key(t *jwt.Token) (any, error) {
+	switch t.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return j.config.HS256Secret, nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := t.Header["kid"].(string)
+		return j.jwks.get(kid)
+	}
+	return nil, fmt.Errorf("unexpected signing method %v", t.Method.Alg())
+}
+
+// Authenticate verify the token and return its subject and roles from the roles claim.
+// Roles claim can be a list or a space separated string, standard scope claim is added too.
+func (j *JWTAuth) Authenticate(raw string) (Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := j.parser.ParseWithClaims(raw, claims, j.key); err != nil {
+		return Principal{}, err
+	}
+
+	sub, _ := claims.GetSubject()
+	p := Principal{Subject: sub, Method: AuthJWT}
+	for _, name := range []string{j.config.RolesClaim, "scope"} {
+		switch v := claims[name].(type) {
+		case string:
+			p.Roles = append(p.Roles, strings.Fields(v)...)
+		case []any:
+			for _, r := range v {
+				if s, ok := r.(string); ok {
+					p.Roles = append(p.Roles, s)
+				}
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// jwksCache keep RSA keys of a jwks url by kid
+type jwksCache struct {
+	url       string
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	triedAt   time.Time
+}
+
+func (c *jwksCache) get(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[kid]
+	if ok && time.Since(c.fetchedAt) < jwksTTL {
+		return key, nil
+	}
+
+	if time.Since(c.triedAt) > jwksRefreshInterval {
+		c.triedAt = time.Now()
+		if err := c.fetch(); err != nil && !ok {
+			return nil, err
+		}
+	}
+
+	// known key is still used when the jwks url is down
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown jwks kid %v", kid)
+}
+
+func (c *jwksCache) fetch() error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("fetching jwks err: %v", err)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching jwks status %v", resp.StatusCode)
+	}
+
+	var data struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("parsing jwks err: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range data.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	return nil
+}
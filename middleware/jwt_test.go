@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/waiwen1001/bike/models"
+)
+
+// noCredentials reject every api key and session, only bearer tokens are tested
+type noCredentials struct{}
+
+func (noCredentials) GetAPIKeyByHash(string) (models.APIKey, error) {
+	return models.APIKey{}, fmt.Errorf("empty row")
+}
+
+func (noCredentials) TouchAPIKey(int64) error {
+	return nil
+}
+
+func (noCredentials) GetSessionUser(string) (models.User, error) {
+	return models.User{}, fmt.Errorf("empty row")
+}
+
+func TestJWTBearerAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "service", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	secret := []byte("shared-secret")
+	auth := NewAuth(noCredentials{}, NewJWTAuth(JWTConfig{
+		HS256Secret: secret, JWKSUrl: jwks.URL, Issuer: "https://issuer.test/", Audience: "bike-api",
+	}))
+	handler := auth.Require(models.ScopeAlertsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	call := func(token string) int {
+		req := httptest.NewRequest("GET", "/api/v1/alerts", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	claims := func(roles any, exp time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{"sub": "svc", "iss": "https://issuer.test/", "aud": "bike-api", "roles": roles, "exp": time.Now().Add(exp).Unix()}
+	}
+	hs := func(c jwt.MapClaims, key []byte) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(key)
+		return token
+	}
+
+	assert.Equal(t, http.StatusOK, call(hs(claims([]string{"alerts:read"}, time.Hour), secret)))
+	assert.Equal(t, http.StatusOK, call(hs(claims("stations:read alerts:read", time.Hour), secret)))
+	assert.Equal(t, http.StatusForbidden, call(hs(claims([]string{"stations:read"}, time.Hour), secret)))
+	assert.Equal(t, http.StatusUnauthorized, call(hs(claims([]string{"alerts:read"}, time.Hour), []byte("other"))))
+	assert.Equal(t, http.StatusUnauthorized, call(hs(claims([]string{"alerts:read"}, -time.Hour), secret)))
+
+	wrongAud := claims([]string{"alerts:read"}, time.Hour)
+	wrongAud["aud"] = "other-api"
+	assert.Equal(t, http.StatusUnauthorized, call(hs(wrongAud, secret)))
+
+	none, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims([]string{"admin"}, time.Hour)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.Equal(t, http.StatusUnauthorized, call(none))
+
+	rs := jwt.NewWithClaims(jwt.SigningMethodRS256, claims([]string{"admin"}, time.Hour))
+	rs.Header["kid"] = "service"
+	signed, err := rs.SignedString(rsaKey)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, call(signed))
+
+	rs.Header["kid"] = "rotated"
+	signed, _ = rs.SignedString(rsaKey)
+	assert.Equal(t, http.StatusUnauthorized, call(signed))
+}
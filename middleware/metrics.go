@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/waiwen1001/bike/metrics"
+)
+
+// Metrics count requests and observe latency by route template, method and status.
+// The wrapped writer keep Flusher, Hijacker and deadlines working for stream routes.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(next, w, r)
+		labels := []string{routeTemplate(r), r.Method, strconv.Itoa(m.Code)}
+		metrics.HTTPRequests.WithLabelValues(labels...).Inc()
+		metrics.HTTPDuration.WithLabelValues(labels...).Observe(m.Duration.Seconds())
+	})
+}
@@ -1,20 +1,194 @@
 package middleware
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
+)
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+const (
+	AuthAPIKey  = "api_key"
+	AuthJWT     = "jwt"
+	AuthSession = "session"
 )
 
-const apiToken = "bike001"
+// SessionCookieName is the cookie set by login
+const SessionCookieName = "bike_session"
+
+// Principal is the caller authorised by an api key, a bearer token or a login session
+type Principal struct {
+	Subject string
+	Method  string
+	// Roles hold the jwt roles claim or the role of the user or api key
+	Roles       []string
+	Permissions []string
+}
+
+func (p Principal) HasPermission(permission string) bool {
+	return slices.Contains(p.Permissions, permission) || slices.Contains(p.Permissions, models.ScopeAdmin)
+}
+
+// AuthStore is the part of models.Storage used to check credentials
+type AuthStore interface {
+	GetAPIKeyByHash(string) (models.APIKey, error)
+	TouchAPIKey(int64) error
+	GetSessionUser(string) (models.User, error)
+}
+
+// RejectFunc is called for request with an invalid credential or missing the permission,
+// actor identify the credential without revealing it and reason explain the rejection
+type RejectFunc func(r *http.Request, status int, actor string, reason string)
+
+type Auth struct {
+	store    AuthStore
+	jwt      *JWTAuth
+	onReject RejectFunc
+}
+
+// NewAuth accept api key in Token header, login session cookie, and bearer token in Authorization header when jwt is not nil
+func NewAuth(store AuthStore, jwt *JWTAuth) *Auth {
+	return &Auth{store: store, jwt: jwt}
+}
 
-func TokenAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Token")
+// OnReject set the function called when a presented credential is rejected, eg. to record an audit event
+func (a *Auth) OnReject(f RejectFunc) *Auth {
+	a.onReject = f
+	return a
+}
 
-		if token != apiToken {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
+func (a *Auth) reject(r *http.Request, status int, actor string, reason string) {
+	if a.onReject != nil {
+		a.onReject(r, status, actor, reason)
+	}
+}
+
+// PrincipalFromContext return the caller authorised the request
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalContextKey).(Principal)
+	return p, ok
+}
+
+func (a *Auth) apiKeyPrincipal(ctx context.Context, token string) (Principal, bool) {
+	end := tracing.StoreSpan(ctx, "GetAPIKeyByHash")
+	key, err := a.store.GetAPIKeyByHash(models.HashToken(token))
+	end(&err)
+	if err != nil {
+		if !strings.Contains(err.Error(), "empty row") {
+			slog.ErrorContext(ctx, "Error getting api key", "err", err)
+		}
+		return Principal{}, false
+	}
+
+	if !key.Valid(time.Now()) {
+		return Principal{}, false
+	}
+
+	end = tracing.StoreSpan(ctx, "TouchAPIKey")
+	err = a.store.TouchAPIKey(key.Id)
+	end(&err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating api key last used", "key", key.Id, "err", err)
+	}
+
+	p := Principal{Subject: "api_key:" + strconv.FormatInt(key.Id, 10), Method: AuthAPIKey, Permissions: key.Permissions()}
+	if key.Role != "" {
+		p.Roles = []string{key.Role}
+	}
+	return p, true
+}
+
+func (a *Auth) sessionPrincipal(ctx context.Context, token string) (Principal, bool) {
+	end := tracing.StoreSpan(ctx, "GetSessionUser")
+	u, err := a.store.GetSessionUser(token)
+	end(&err)
+	if err != nil {
+		if !strings.Contains(err.Error(), "empty row") {
+			slog.ErrorContext(ctx, "Error getting session user", "err", err)
 		}
+		return Principal{}, false
+	}
+
+	return Principal{Subject: "user:" + u.Username, Method: AuthSession, Roles: []string{u.Role}, Permissions: models.RolePermissions[u.Role]}, true
+}
+
+// jwtPrincipal map each role claim value to the permissions of the role, a value naming a scope grant the scope
+func (a *Auth) jwtPrincipal(ctx context.Context, token string) (Principal, bool) {
+	if a.jwt == nil {
+		return Principal{}, false
+	}
+
+	p, err := a.jwt.Authenticate(token)
+	if err != nil {
+		slog.InfoContext(ctx, "Bearer token rejected", "err", err)
+		return Principal{}, false
+	}
+
+	for _, role := range p.Roles {
+		if models.ValidRole(role) {
+			p.Permissions = append(p.Permissions, models.RolePermissions[role]...)
+		} else if slices.Contains(models.Scopes, role) {
+			p.Permissions = append(p.Permissions, role)
+		}
+	}
+	return p, true
+}
+
+// tokenPrefix keep the stored prefix of an api key to recognise it, other token are not recorded
+func tokenPrefix(token string) string {
+	if strings.HasPrefix(token, "bk_") && len(token) > 11 {
+		return token[:11]
+	}
+	return "unknown"
+}
+
+// Require reject request without valid credential with 401, or missing the permission with 403
+func (a *Auth) Require(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var p Principal
+			var ok bool
+			// actor of a rejected credential, empty when no credential is presented
+			var actor string
+			if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+				p, ok = a.jwtPrincipal(r.Context(), strings.TrimSpace(bearer))
+				actor = AuthJWT
+				if !ok {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				}
+			} else if token := r.Header.Get("Token"); token != "" {
+				p, ok = a.apiKeyPrincipal(r.Context(), token)
+				actor = AuthAPIKey + ":" + tokenPrefix(token)
+			} else if c, err := r.Cookie(SessionCookieName); err == nil && c.Value != "" {
+				p, ok = a.sessionPrincipal(r.Context(), c.Value)
+				actor = AuthSession
+			}
+
+			if !ok {
+				if actor != "" {
+					a.reject(r, http.StatusUnauthorized, actor, "invalid credential")
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !p.HasPermission(permission) {
+				a.reject(r, http.StatusForbidden, p.Subject, "missing permission "+permission)
+				http.Error(w, "Forbidden : missing permission "+permission, http.StatusForbidden)
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey, p)))
+		})
+	}
 }
@@ -0,0 +1,331 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/models"
+	"github.com/waiwen1001/bike/tracing"
+)
+
+const (
+	defaultRouteKey = "default"
+	// sweep full buckets once memory store grow over this size
+	rateLimitSweepSize = 10000
+	// buckets checked per request while sweeping, keep the time under the lock bounded
+	rateLimitSweepBatch = 64
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parse "rate/unit:burst", eg. 30/m:10, unit is s, m or h, burst default to rate
+func ParseRateLimit(v string) (RateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(strings.TrimSpace(v), ":")
+	count, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %v, expect rate/unit:burst", v)
+	}
+
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %v, rate must be positive", v)
+	}
+
+	per := map[string]float64{"s": 1, "m": 60, "h": 3600}[unit]
+	if per == 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %v, unit must be s, m or h", v)
+	}
+
+	limit := RateLimit{Rate: n / per, Burst: int(math.Ceil(n))}
+	if hasBurst {
+		limit.Burst, err = strconv.Atoi(burst)
+		if err != nil || limit.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %v, burst must be positive", v)
+		}
+	}
+	return limit, nil
+}
+
+// ParseRouteLimits parse comma separated route=limit, route is a path template or default
+func ParseRouteLimits(v string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, part := range strings.Split(v, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		route, limit, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route rate limit %v, expect route=rate/unit:burst", part)
+		}
+
+		l, err := ParseRateLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(route)] = l
+	}
+	return limits, nil
+}
+
+// RateLimitStore take one token of the bucket, return tokens left and whether the token was taken
+type RateLimitStore interface {
+	TakeRateLimitToken(key string, rate float64, burst int) (float64, bool, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// limit of the last take, a sweep refill the bucket with it
+	rate  float64
+	burst int
+}
+
+// full return whether the bucket refilled to burst, dropping it is the same as starting a new one
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst)
+}
+
+// MemoryRateLimitStore keep buckets of this process only
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*bucket)}
+}
+
+func (m *MemoryRateLimitStore) TakeRateLimitToken(key string, rate float64, burst int) (float64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if len(m.buckets) >= rateLimitSweepSize {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	b.rate, b.burst = rate, burst
+	if b.tokens < 1 {
+		return b.tokens, false, nil
+	}
+
+	b.tokens--
+	return b.tokens, true, nil
+}
+
+// sweep check a batch of buckets and drop the full ones, map iteration start at a random bucket so
+// every request look at a different batch
+func (m *MemoryRateLimitStore) sweep(now time.Time) {
+	checked := 0
+	for k, b := range m.buckets {
+		if b.full(now) {
+			delete(m.buckets, k)
+		}
+		checked++
+		if checked >= rateLimitSweepBatch {
+			return
+		}
+	}
+}
+
+type RateLimiter struct {
+	store RateLimitStore
+	// limits per credential and per client ip, by route path template
+	keyLimits  map[string]RateLimit
+	ipLimits   map[string]RateLimit
+	trustProxy bool
+}
+
+var (
+	defaultKeyLimits = map[string]RateLimit{
+		defaultRouteKey:    {Rate: 2, Burst: 60},
+		"/api/v1/stations": {Rate: 0.5, Burst: 10},
+	}
+	defaultIPLimits = map[string]RateLimit{
+		defaultRouteKey:    {Rate: 5, Burst: 100},
+		"/api/v1/stations": {Rate: 1, Burst: 20},
+		"/api/v1/login":    {Rate: 0.2, Burst: 10},
+	}
+)
+
+func NewRateLimiter(store RateLimitStore, keyLimits map[string]RateLimit, ipLimits map[string]RateLimit, trustProxy bool) *RateLimiter {
+	return &RateLimiter{store: store, keyLimits: keyLimits, ipLimits: ipLimits, trustProxy: trustProxy}
+}
+
+// NewRateLimiterFromConfig parse the per credential and per client ip route=rate/unit:burst lists,
+// listed routes replace the defaults. trustProxy use X-Forwarded-For as client ip.
+func NewRateLimiterFromConfig(store RateLimitStore, c config.RateLimit, trustProxy bool) (*RateLimiter, error) {
+	keyLimits, err := routeLimits("RATE_LIMITS", c.Limits, defaultKeyLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	ipLimits, err := routeLimits("RATE_LIMITS_IP", c.IPLimits, defaultIPLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRateLimiter(store, keyLimits, ipLimits, trustProxy), nil
+}
+
+func routeLimits(key string, v string, defaults map[string]RateLimit) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for k, v := range defaults {
+		limits[k] = v
+	}
+
+	custom, err := ParseRouteLimits(v)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", key, err)
+	}
+	for k, v := range custom {
+		limits[k] = v
+	}
+	return limits, nil
+}
+
+func routeLimit(limits map[string]RateLimit, route string) (RateLimit, string) {
+	if l, ok := limits[route]; ok {
+		return l, route
+	}
+	return limits[defaultRouteKey], defaultRouteKey
+}
+
+// ClientIP return the last X-Forwarded-For address when trustProxy, else the remote address.
+// The proxy append the address it saw to the end, entries before it are sent by the client and can be forged.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			last := forwarded[len(forwarded)-1]
+			if i := strings.LastIndex(last, ","); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// routeTemplate return the matched mux path template, eg. /api/v1/stations/{kioskId}, so ids do not make new labels or buckets
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+// credential return hash of the api key, bearer token or session of the request, empty when anonymous
+func credential(r *http.Request) string {
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return models.HashToken(strings.TrimSpace(bearer))
+	}
+	if token := r.Header.Get("Token"); token != "" {
+		return models.HashToken(token)
+	}
+	if c, err := r.Cookie(SessionCookieName); err == nil && c.Value != "" {
+		return models.HashToken(c.Value)
+	}
+	return ""
+}
+
+type rateResult struct {
+	limit      RateLimit
+	tokens     float64
+	allowed    bool
+	retryAfter time.Duration
+}
+
+func (l *RateLimiter) take(ctx context.Context, key string, limit RateLimit) rateResult {
+	res := rateResult{limit: limit, allowed: true, tokens: float64(limit.Burst)}
+	var tokens float64
+	var allowed bool
+	var err error
+	if _, memory := l.store.(*MemoryRateLimitStore); memory {
+		tokens, allowed, err = l.store.TakeRateLimitToken(key, limit.Rate, limit.Burst)
+	} else {
+		// shared store query the database on every request
+		end := tracing.StoreSpan(ctx, "TakeRateLimitToken")
+		tokens, allowed, err = l.store.TakeRateLimitToken(key, limit.Rate, limit.Burst)
+		end(&err)
+	}
+	if err != nil {
+		// do not block clients when the shared store is down
+		slog.ErrorContext(ctx, "Error taking rate limit token", "err", err)
+		return res
+	}
+
+	res.tokens = tokens
+	res.allowed = allowed
+	if !allowed {
+		res.retryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return res
+}
+
+// Middleware take a token from the bucket of the credential and of the client ip for the matched route,
+// the most restrictive bucket is reported in X-RateLimit-* headers
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		ipLimit, ipRoute := routeLimit(l.ipLimits, route)
+		results := []rateResult{l.take(r.Context(), "ip:"+ClientIP(r, l.trustProxy)+":"+ipRoute, ipLimit)}
+		// request rejected by ip limit does not use the credential bucket
+		if cred := credential(r); cred != "" && results[0].allowed {
+			keyLimit, keyRoute := routeLimit(l.keyLimits, route)
+			results = append(results, l.take(r.Context(), "key:"+cred[:16]+":"+keyRoute, keyLimit))
+		}
+
+		worst := results[0]
+		for _, res := range results[1:] {
+			if !res.allowed && worst.allowed || res.allowed == worst.allowed && res.tokens < worst.tokens {
+				worst = res
+			}
+		}
+
+		reset := (float64(worst.limit.Burst) - worst.tokens) / worst.limit.Rate
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(worst.limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(worst.tokens)))))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+
+		if !worst.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(worst.retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	l, err := ParseRateLimit("30/m:10")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, l.Rate)
+	assert.Equal(t, 10, l.Burst)
+
+	l, err = ParseRateLimit("5/s")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, l.Burst)
+
+	for _, v := range []string{"30", "0/m", "30/d", "30/m:0"} {
+		_, err := ParseRateLimit(v)
+		assert.NotNil(t, err, v)
+	}
+
+	limits, err := ParseRouteLimits("default=60/m, /api/v1/stations=10/m:2")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, limits["/api/v1/stations"].Burst)
+}
+
+func TestRateLimitPerKeyAndIP(t *testing.T) {
+	slow := RateLimit{Rate: 0.01, Burst: 2}
+	limiter := NewRateLimiter(NewMemoryRateLimitStore(),
+		map[string]RateLimit{"default": {Rate: 1, Burst: 100}, "/api/v1/alerts": slow},
+		map[string]RateLimit{"default": {Rate: 0.01, Burst: 3}},
+		false,
+	)
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware)
+	router.HandleFunc("/api/v1/alerts", func(w http.ResponseWriter, r *http.Request) {})
+	call := func(key string, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/alerts", nil)
+		req.Header.Set("Token", key)
+		req.RemoteAddr = ip + ":5000"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := call("bk_a", "10.0.0.1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, http.StatusOK, call("bk_a", "10.0.0.2").Code)
+
+	// key a used its route burst from two ips
+	rr = call("bk_a", "10.0.0.3")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "100", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+
+	// key b has its own bucket but 10.0.0.1 reach the ip burst of 3
+	assert.Equal(t, http.StatusOK, call("bk_b", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, call("bk_b", "10.0.0.1").Code)
+	rr = call("bk_b", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "3", rr.Header().Get("X-RateLimit-Limit"))
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/v1/stations", nil)
+	req.RemoteAddr = "10.0.0.9:5000"
+	assert.Equal(t, "10.0.0.9", ClientIP(req, true))
+
+	// the client sent 1.2.3.4, the proxy appended the address it saw
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	assert.Equal(t, "203.0.113.7", ClientIP(req, true))
+	assert.Equal(t, "10.0.0.9", ClientIP(req, false))
+
+	req.Header.Add("X-Forwarded-For", "198.51.100.2")
+	assert.Equal(t, "198.51.100.2", ClientIP(req, true))
+
+	req.Header.Set("X-Forwarded-For", "1.2.3.4,")
+	assert.Equal(t, "10.0.0.9", ClientIP(req, true))
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	m := NewMemoryRateLimitStore()
+	for i := 0; i < rateLimitSweepSize; i++ {
+		m.buckets[strconv.Itoa(i)] = &bucket{tokens: 5, last: time.Now(), rate: 1, burst: 5}
+	}
+	// still limited, must survive the sweep
+	m.buckets["busy"] = &bucket{tokens: 0, last: time.Now(), rate: 0.001, burst: 5}
+
+	_, ok, err := m.TakeRateLimitToken("new", 1, 5)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// one request only check a batch, busy may be in it and kept
+	assert.InDelta(t, rateLimitSweepSize+2-rateLimitSweepBatch, len(m.buckets), 1)
+
+	for len(m.buckets) >= rateLimitSweepSize {
+		m.TakeRateLimitToken("new", 1, 5)
+	}
+	_, ok = m.buckets["busy"]
+	assert.True(t, ok)
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/logging"
+)
+
+func TestValidRequestID(t *testing.T) {
+	for _, id := range []string{"req-123", "4bf92f3577b34da6a3ce929d0e0e4736", "a.b_c:d"} {
+		assert.True(t, validRequestID(id), id)
+	}
+	for _, id := range []string{"", "bad id", "line\n{}", strings.Repeat("a", maxRequestIDLength+1)} {
+		assert.False(t, validRequestID(id), id)
+	}
+}
+
+func TestRequestIDLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&buf, config.Log{Level: "info", Format: "json"}))
+
+	handler := RequestID(AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "Handled")
+	})))
+	call := func(id string) string {
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header().Get(RequestIDHeader)
+	}
+
+	// valid id of the caller is kept and tag every line of the request
+	assert.Equal(t, "req-123", call("req-123"))
+	dec := json.NewDecoder(&buf)
+	for _, msg := range []string{"Handled", "Request"} {
+		var line map[string]any
+		assert.Nil(t, dec.Decode(&line))
+		assert.Equal(t, msg, line["msg"])
+		assert.Equal(t, "req-123", line["request_id"])
+	}
+
+	// missing or unsafe id is replaced
+	assert.Len(t, call(""), 32)
+	id := call("bad id\n{}")
+	assert.Len(t, id, 32)
+	assert.NotEqual(t, call(""), id)
+}
@@ -0,0 +1,255 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	AlertBikesBelow = "bikes_below"
+	AlertDocksBelow = "docks_below"
+	AlertStatusIs   = "status_is"
+)
+
+// AlertRule notify webhook when condition hold for DurationMinutes, KioskId nil mean any station
+type AlertRule struct {
+	Id              int64     `json:"id"`
+	Name            string    `json:"name"`
+	KioskId         *int64    `json:"kioskId"`
+	Condition       string    `json:"condition"`
+	Threshold       int64     `json:"threshold"`
+	Status          string    `json:"status"`
+	DurationMinutes int64     `json:"durationMinutes"`
+	WebhookUrl      string    `json:"webhookUrl"`
+	Secret          string    `json:"secret,omitempty"`
+	Active          bool      `json:"active"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// AlertState track since when a rule condition is true for a kiosk
+type AlertState struct {
+	RuleId   int64
+	KioskId  int64
+	Since    time.Time
+	Notified bool
+}
+
+type AlertDelivery struct {
+	Id           int64      `json:"id"`
+	RuleId       int64      `json:"ruleId"`
+	KioskId      int64      `json:"kioskId"`
+	Payload      string     `json:"payload"`
+	Status       string     `json:"status"`
+	Attempts     int64      `json:"attempts"`
+	ResponseCode *int64     `json:"responseCode"`
+	LastError    *string    `json:"lastError"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	DeliveredAt  *time.Time `json:"deliveredAt"`
+}
+
+func (s *PostgresStore) createAlertTables() error {
+	query := `CREATE TABLE IF NOT EXISTS alert_rules (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255),
+		kiosk_id INT,
+		condition VARCHAR(50) NOT NULL,
+		threshold INT,
+		status VARCHAR(255),
+		duration_minutes INT,
+		webhook_url TEXT NOT NULL,
+		secret VARCHAR(255),
+		active BOOLEAN,
+		created_at TIMESTAMP,
+		updated_at TIMESTAMP
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS alert_states (
+		rule_id INT REFERENCES alert_rules(id) ON DELETE CASCADE,
+		kiosk_id INT,
+		since TIMESTAMP,
+		notified BOOLEAN,
+		PRIMARY KEY (rule_id, kiosk_id)
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS alert_deliveries (
+		id SERIAL PRIMARY KEY,
+		rule_id INT REFERENCES alert_rules(id) ON DELETE CASCADE,
+		kiosk_id INT,
+		payload TEXT,
+		status VARCHAR(50),
+		attempts INT,
+		response_code INT,
+		last_error TEXT,
+		created_at TIMESTAMP,
+		delivered_at TIMESTAMP
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.Db.Exec(`CREATE INDEX IF NOT EXISTS idx_alert_deliveries_rule_id ON alert_deliveries (rule_id)`)
+	return err
+}
+
+const alertRuleColumns = "id, name, kiosk_id, condition, threshold, status, duration_minutes, webhook_url, secret, active, created_at, updated_at"
+
+func scanAlertRule(row interface{ Scan(...any) error }) (AlertRule, error) {
+	a := AlertRule{}
+	err := row.Scan(&a.Id, &a.Name, &a.KioskId, &a.Condition, &a.Threshold, &a.Status, &a.DurationMinutes, &a.WebhookUrl, &a.Secret, &a.Active, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+func (s *PostgresStore) CreateAlertRule(a *AlertRule) error {
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = a.CreatedAt
+	query := "INSERT INTO alert_rules (name, kiosk_id, condition, threshold, status, duration_minutes, webhook_url, secret, active, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id"
+	err := s.Db.QueryRow(query, a.Name, a.KioskId, a.Condition, a.Threshold, a.Status, a.DurationMinutes, a.WebhookUrl, a.Secret, a.Active, a.CreatedAt, a.UpdatedAt).Scan(&a.Id)
+	if err != nil {
+		return fmt.Errorf("failed to insert alert rule: %v", err)
+	}
+	return nil
+}
+
+// GetAlertRules return rules by id after page.AfterId, page.Limit 0 return every rule
+func (s *PostgresStore) GetAlertRules(page Page) ([]AlertRule, error) {
+	var limit any
+	if page.Limit > 0 {
+		limit = page.Limit
+	}
+
+	rows, err := s.Db.Query(fmt.Sprintf("SELECT %v FROM alert_rules WHERE id > $1 ORDER BY id LIMIT $2", alertRuleColumns), page.AfterId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		a, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		rules = append(rules, a)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *PostgresStore) GetAlertRule(id int64) (AlertRule, error) {
+	a, err := scanAlertRule(s.Db.QueryRow(fmt.Sprintf("SELECT %v FROM alert_rules WHERE id = $1", alertRuleColumns), id))
+	if err == sql.ErrNoRows {
+		return AlertRule{}, fmt.Errorf("empty row")
+	}
+	if err != nil {
+		return AlertRule{}, fmt.Errorf("failed to scan row: %v", err)
+	}
+	return a, nil
+}
+
+func (s *PostgresStore) UpdateAlertRule(a *AlertRule) error {
+	a.UpdatedAt = time.Now()
+	query := "UPDATE alert_rules SET name = $1, kiosk_id = $2, condition = $3, threshold = $4, status = $5, duration_minutes = $6, webhook_url = $7, active = $8, updated_at = $9 WHERE id = $10"
+	res, err := s.Db.Exec(query, a.Name, a.KioskId, a.Condition, a.Threshold, a.Status, a.DurationMinutes, a.WebhookUrl, a.Active, a.UpdatedAt, a.Id)
+	if err != nil {
+		return fmt.Errorf("failed to update alert rule: %v", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("empty row")
+	}
+
+	// condition changed, start tracking again
+	_, err = s.Db.Exec("DELETE FROM alert_states WHERE rule_id = $1", a.Id)
+	return err
+}
+
+func (s *PostgresStore) DeleteAlertRule(id int64) error {
+	res, err := s.Db.Exec("DELETE FROM alert_rules WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete alert rule: %v", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("empty row")
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetAlertStates(ruleId int64) (map[int64]AlertState, error) {
+	rows, err := s.Db.Query("SELECT rule_id, kiosk_id, since, notified FROM alert_states WHERE rule_id = $1", ruleId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	states := make(map[int64]AlertState)
+	for rows.Next() {
+		st := AlertState{}
+		if err := rows.Scan(&st.RuleId, &st.KioskId, &st.Since, &st.Notified); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		states[st.KioskId] = st
+	}
+
+	return states, rows.Err()
+}
+
+func (s *PostgresStore) SaveAlertState(st AlertState) error {
+	query := `INSERT INTO alert_states (rule_id, kiosk_id, since, notified) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (rule_id, kiosk_id) DO UPDATE SET since = EXCLUDED.since, notified = EXCLUDED.notified`
+	_, err := s.Db.Exec(query, st.RuleId, st.KioskId, st.Since, st.Notified)
+	return err
+}
+
+func (s *PostgresStore) DeleteAlertState(ruleId int64, kioskId int64) error {
+	_, err := s.Db.Exec("DELETE FROM alert_states WHERE rule_id = $1 AND kiosk_id = $2", ruleId, kioskId)
+	return err
+}
+
+func (s *PostgresStore) CreateAlertDelivery(d *AlertDelivery) error {
+	d.CreatedAt = time.Now()
+	query := "INSERT INTO alert_deliveries (rule_id, kiosk_id, payload, status, attempts, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id"
+	err := s.Db.QueryRow(query, d.RuleId, d.KioskId, d.Payload, d.Status, d.Attempts, d.CreatedAt).Scan(&d.Id)
+	if err != nil {
+		return fmt.Errorf("failed to insert alert delivery: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) UpdateAlertDelivery(d *AlertDelivery) error {
+	query := "UPDATE alert_deliveries SET status = $1, attempts = $2, response_code = $3, last_error = $4, delivered_at = $5 WHERE id = $6"
+	_, err := s.Db.Exec(query, d.Status, d.Attempts, d.ResponseCode, d.LastError, d.DeliveredAt, d.Id)
+	return err
+}
+
+// GetAlertDeliveries return newest deliveries of the rule first, page.AfterId continue below the last returned id
+func (s *PostgresStore) GetAlertDeliveries(ruleId int64, page Page) ([]AlertDelivery, error) {
+	query := "SELECT id, rule_id, kiosk_id, payload, status, attempts, response_code, last_error, created_at, delivered_at FROM alert_deliveries WHERE rule_id = $1 AND ($2::bigint = 0 OR id < $2) ORDER BY id DESC LIMIT $3"
+	rows, err := s.Db.Query(query, ruleId, page.AfterId, page.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := []AlertDelivery{}
+	for rows.Next() {
+		d := AlertDelivery{}
+		if err := rows.Scan(&d.Id, &d.RuleId, &d.KioskId, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// scopes are the permissions checked on each route
+const (
+	ScopeStationsRead  = "stations:read"
+	ScopeAnalyticsRead = "analytics:read"
+	ScopeIngestWrite   = "ingest:write"
+	ScopeAlertsRead    = "alerts:read"
+	ScopeAlertsWrite   = "alerts:write"
+	ScopeKeysManage    = "keys:manage"
+	ScopeDataDelete    = "data:delete"
+	ScopeAuditRead     = "audit:read"
+	// admin is granted every scope
+	ScopeAdmin = "admin"
+)
+
+var Scopes = []string{ScopeStationsRead, ScopeAnalyticsRead, ScopeIngestWrite, ScopeAlertsRead, ScopeAlertsWrite, ScopeKeysManage, ScopeDataDelete, ScopeAuditRead, ScopeAdmin}
+
+// APIKey is a client key, only the sha256 hash of the key is stored and Prefix is kept to recognise it.
+// Scopes narrow the permissions of Role, key issued before roles has no role and only its scopes.
+type APIKey struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Role       string     `json:"role"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func (k APIKey) Permissions() []string {
+	return Permissions(k.Role, k.Scopes)
+}
+
+// Valid return false when the key is revoked or expired
+func (k APIKey) Valid(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+func (s *PostgresStore) createAPIKeyTable() error {
+	query := `CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255),
+		owner VARCHAR(255),
+		prefix VARCHAR(20),
+		key_hash VARCHAR(64) NOT NULL UNIQUE,
+		scopes TEXT[],
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		created_at TIMESTAMP
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.Db.Exec(`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS role VARCHAR(50) NOT NULL DEFAULT ''`)
+	return err
+}
+
+const apiKeyColumns = "id, name, owner, prefix, key_hash, role, scopes, expires_at, last_used_at, revoked_at, created_at"
+
+func scanAPIKey(row interface{ Scan(...any) error }) (APIKey, error) {
+	k := APIKey{}
+	err := row.Scan(&k.Id, &k.Name, &k.Owner, &k.Prefix, &k.KeyHash, &k.Role, pq.Array(&k.Scopes), &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt)
+	return k, err
+}
+
+func (s *PostgresStore) CreateAPIKey(k *APIKey) error {
+	k.CreatedAt = time.Now()
+	query := "INSERT INTO api_keys (name, owner, prefix, key_hash, role, scopes, expires_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	err := s.Db.QueryRow(query, k.Name, k.Owner, k.Prefix, k.KeyHash, k.Role, pq.Array(k.Scopes), k.ExpiresAt, k.CreatedAt).Scan(&k.Id)
+	if err != nil {
+		return fmt.Errorf("failed to insert api key: %v", err)
+	}
+	return nil
+}
+
+// GetAPIKeys return keys by id after page.AfterId
+func (s *PostgresStore) GetAPIKeys(page Page) ([]APIKey, error) {
+	rows, err := s.Db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE id > $1 ORDER BY id LIMIT $2", page.AfterId, page.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	k, err := scanAPIKey(s.Db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1", keyHash))
+	if err == sql.ErrNoRows {
+		return k, fmt.Errorf("empty row")
+	}
+	if err != nil {
+		return k, fmt.Errorf("failed to select query: %v", err)
+	}
+	return k, nil
+}
+
+// TouchAPIKey record the key was used now
+func (s *PostgresStore) TouchAPIKey(id int64) error {
+	if _, err := s.Db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", time.Now(), id); err != nil {
+		return fmt.Errorf("failed to update api key: %v", err)
+	}
+	return nil
+}
+
+// RevokeAPIKey keep the row for audit, revoked key is rejected by the middleware
+func (s *PostgresStore) RevokeAPIKey(id int64) error {
+	res, err := s.Db.Exec("UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update api key: %v", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("empty row")
+	}
+	return nil
+}
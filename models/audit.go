@@ -0,0 +1,168 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// audit actions
+const (
+	AuditLogin         = "login"
+	AuditLogout        = "logout"
+	AuditAuthRejected  = "auth.rejected"
+	AuditAuthForbidden = "auth.forbidden"
+	AuditIngest        = "ingest.trigger"
+	AuditKeyIssue      = "api_key.issue"
+	AuditKeyRevoke     = "api_key.revoke"
+	AuditAlertCreate   = "alert.create"
+	AuditAlertUpdate   = "alert.update"
+	AuditAlertDelete   = "alert.delete"
+	AuditDataDelete    = "snapshots.delete"
+)
+
+// audit outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// AuditEvent record who did what on which target, events are never updated or deleted by the api
+type AuditEvent struct {
+	Id        int64     `json:"id"`
+	At        time.Time `json:"at"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail"`
+}
+
+// audit column sizes, longer values from the request are cut so the insert does not fail
+const (
+	auditMaxActor  = 255
+	auditMaxTarget = 255
+	auditMaxIP     = 64
+	auditMaxDetail = 1024
+)
+
+// Truncate cut actor, target, ip, user agent and detail to what the audit_events columns accept
+func (e *AuditEvent) Truncate() {
+	e.Actor = truncate(e.Actor, auditMaxActor)
+	e.Target = truncate(e.Target, auditMaxTarget)
+	e.IP = truncate(e.IP, auditMaxIP)
+	e.UserAgent = truncate(e.UserAgent, auditMaxDetail)
+	e.Detail = truncate(e.Detail, auditMaxDetail)
+}
+
+// truncate keep at most max characters, a cut value end with "..." so it is not mistaken for the real one
+func truncate(v string, max int) string {
+	r := []rune(v)
+	if len(r) <= max {
+		return v
+	}
+	return string(r[:max-3]) + "..."
+}
+
+// AuditFilter select events, empty fields match every event
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	From    *time.Time
+	To      *time.Time
+}
+
+func (s *PostgresStore) createAuditTable() error {
+	query := `CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGSERIAL PRIMARY KEY,
+		at TIMESTAMP NOT NULL,
+		actor VARCHAR(255),
+		action VARCHAR(50) NOT NULL,
+		target VARCHAR(255),
+		ip VARCHAR(64),
+		user_agent TEXT,
+		outcome VARCHAR(20) NOT NULL,
+		detail TEXT
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.Db.Exec(`CREATE INDEX IF NOT EXISTS idx_audit_events_at ON audit_events (at)`)
+	return err
+}
+
+func (s *PostgresStore) CreateAuditEvent(e *AuditEvent) error {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+
+	query := "INSERT INTO audit_events (at, actor, action, target, ip, user_agent, outcome, detail) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	err := s.Db.QueryRow(query, e.At, e.Actor, e.Action, e.Target, e.IP, e.UserAgent, e.Outcome, e.Detail).Scan(&e.Id)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit event: %v", err)
+	}
+	return nil
+}
+
+// GetAuditEvents return newest events first, page.AfterId continue below the last returned id
+func (s *PostgresStore) GetAuditEvents(filter AuditFilter, page Page) ([]AuditEvent, error) {
+	conds := []string{}
+	args := []any{}
+	where := func(cond string, v any) {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.Actor != "" {
+		where("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.Target != "" {
+		where("target = $%d", filter.Target)
+	}
+	if filter.Outcome != "" {
+		where("outcome = $%d", filter.Outcome)
+	}
+	if filter.From != nil {
+		where("at >= $%d", *filter.From)
+	}
+	if filter.To != nil {
+		where("at < $%d", *filter.To)
+	}
+	if page.AfterId > 0 {
+		where("id < $%d", page.AfterId)
+	}
+
+	query := "SELECT id, at, actor, action, target, ip, user_agent, outcome, detail FROM audit_events"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, page.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := s.Db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		e := AuditEvent{}
+		if err := rows.Scan(&e.Id, &e.At, &e.Actor, &e.Action, &e.Target, &e.IP, &e.UserAgent, &e.Outcome, &e.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
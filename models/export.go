@@ -0,0 +1,247 @@
+package models
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ExportRow is one exported record, it know how to render itself as csv
+type ExportRow interface {
+	CSVHeader() []string
+	CSVRecord() []string
+}
+
+type ExportStation struct {
+	UpdatedAt              string  `json:"updatedAt" parquet:"name=updated_at, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Id                     int64   `json:"id" parquet:"name=id, type=INT64"`
+	KioskId                int64   `json:"kioskId" parquet:"name=kiosk_id, type=INT64"`
+	Name                   string  `json:"name" parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Latitude               float64 `json:"latitude" parquet:"name=latitude, type=DOUBLE"`
+	Longitude              float64 `json:"longitude" parquet:"name=longitude, type=DOUBLE"`
+	TotalDocks             int64   `json:"totalDocks" parquet:"name=total_docks, type=INT64"`
+	DocksAvailable         int64   `json:"docksAvailable" parquet:"name=docks_available, type=INT64"`
+	BikesAvailable         int64   `json:"bikesAvailable" parquet:"name=bikes_available, type=INT64"`
+	ClassicBikesAvailable  int64   `json:"classicBikesAvailable" parquet:"name=classic_bikes_available, type=INT64"`
+	SmartBikesAvailable    int64   `json:"smartBikesAvailable" parquet:"name=smart_bikes_available, type=INT64"`
+	ElectricBikesAvailable int64   `json:"electricBikesAvailable" parquet:"name=electric_bikes_available, type=INT64"`
+	KioskStatus            string  `json:"kioskStatus" parquet:"name=kiosk_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	KioskPublicStatus      string  `json:"kioskPublicStatus" parquet:"name=kiosk_public_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+func (e ExportStation) CSVHeader() []string {
+	return []string{"updated_at", "id", "kiosk_id", "name", "latitude", "longitude", "total_docks", "docks_available", "bikes_available", "classic_bikes_available", "smart_bikes_available", "electric_bikes_available", "kiosk_status", "kiosk_public_status"}
+}
+
+func (e ExportStation) CSVRecord() []string {
+	return []string{
+		e.UpdatedAt,
+		strconv.FormatInt(e.Id, 10),
+		strconv.FormatInt(e.KioskId, 10),
+		e.Name,
+		strconv.FormatFloat(e.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(e.Longitude, 'f', -1, 64),
+		strconv.FormatInt(e.TotalDocks, 10),
+		strconv.FormatInt(e.DocksAvailable, 10),
+		strconv.FormatInt(e.BikesAvailable, 10),
+		strconv.FormatInt(e.ClassicBikesAvailable, 10),
+		strconv.FormatInt(e.SmartBikesAvailable, 10),
+		strconv.FormatInt(e.ElectricBikesAvailable, 10),
+		e.KioskStatus,
+		e.KioskPublicStatus,
+	}
+}
+
+type ExportBike struct {
+	UpdatedAt string `json:"updatedAt"`
+	KioskId   int64  `json:"kioskId"`
+	Bike
+}
+
+func (e ExportBike) CSVHeader() []string {
+	return []string{"updated_at", "kiosk_id", "dock_number", "is_electric", "is_available", "battery"}
+}
+
+func (e ExportBike) CSVRecord() []string {
+	return []string{
+		e.UpdatedAt,
+		strconv.FormatInt(e.KioskId, 10),
+		formatNullInt(e.DockNumber),
+		formatNullBool(e.IsElectric),
+		formatNullBool(e.IsAvailable),
+		formatNullInt(e.Battery),
+	}
+}
+
+// parquetBike is the flat parquet schema of ExportBike, null fields stay null
+type parquetBike struct {
+	UpdatedAt   string `parquet:"name=updated_at, type=BYTE_ARRAY, convertedtype=UTF8"`
+	KioskId     int64  `parquet:"name=kiosk_id, type=INT64"`
+	DockNumber  *int64 `parquet:"name=dock_number, type=INT64, repetitiontype=OPTIONAL"`
+	IsElectric  *bool  `parquet:"name=is_electric, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	IsAvailable *bool  `parquet:"name=is_available, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	Battery     *int64 `parquet:"name=battery, type=INT64, repetitiontype=OPTIONAL"`
+}
+
+func formatNullInt(v *int64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func formatNullBool(v *bool) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatBool(*v)
+}
+
+// parquet keep the current row group in memory, write it out every n rows to bound memory of large exports
+const parquetRowGroupRows = 10000
+
+// ExportWriter write rows one by one to underlying writer without buffering whole result.
+// Flush send buffered rows, Close flush and finish the file, eg. the parquet footer.
+type ExportWriter interface {
+	Write(ExportRow) error
+	Flush() error
+	Close() error
+}
+
+// NewExportWriter return the writer of format, withBikes select the parquet schema so empty export is still a valid file
+func NewExportWriter(w io.Writer, format string, withBikes bool) (ExportWriter, error) {
+	switch format {
+	case "csv":
+		return &csvExportWriter{w: csv.NewWriter(w)}, nil
+	case "ndjson":
+		return &ndjsonExportWriter{enc: json.NewEncoder(w)}, nil
+	case "parquet":
+		var schema interface{} = new(ExportStation)
+		if withBikes {
+			schema = new(parquetBike)
+		}
+		pw, err := writer.NewParquetWriterFromWriter(w, schema, 1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parquet writer: %v", err)
+		}
+		return &parquetExportWriter{pw: pw}, nil
+	}
+	return nil, fmt.Errorf("invalid format: %s", format)
+}
+
+type csvExportWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (c *csvExportWriter) Write(row ExportRow) error {
+	if !c.headerWritten {
+		if err := c.w.Write(row.CSVHeader()); err != nil {
+			return err
+		}
+		c.headerWritten = true
+	}
+	return c.w.Write(row.CSVRecord())
+}
+
+func (c *csvExportWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvExportWriter) Close() error {
+	return c.Flush()
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonExportWriter) Write(row ExportRow) error {
+	return n.enc.Encode(row)
+}
+
+func (n *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+func (n *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type parquetExportWriter struct {
+	pw   *writer.ParquetWriter
+	rows int
+}
+
+func (p *parquetExportWriter) Write(row ExportRow) error {
+	var rec interface{}
+	switch r := row.(type) {
+	case ExportStation:
+		rec = r
+	case ExportBike:
+		rec = parquetBike{UpdatedAt: r.UpdatedAt, KioskId: r.KioskId, DockNumber: r.DockNumber, IsElectric: r.IsElectric, IsAvailable: r.IsAvailable, Battery: r.Battery}
+	default:
+		return fmt.Errorf("unsupported parquet row: %T", row)
+	}
+
+	if err := p.pw.Write(rec); err != nil {
+		return err
+	}
+
+	p.rows++
+	if p.rows%parquetRowGroupRows == 0 {
+		return p.pw.Flush(true)
+	}
+	return nil
+}
+
+// Flush do nothing, row groups are written every parquetRowGroupRows so they are not cut into tiny groups by the http flush
+func (p *parquetExportWriter) Flush() error {
+	return nil
+}
+
+// Close write the last row group and the footer, the file is unreadable without it
+func (p *parquetExportWriter) Close() error {
+	return p.pw.WriteStop()
+}
+
+// ExportStations stream station rows (or bike rows when withBikes) between from and to into fn, kioskId nil export every station
+func (s *PostgresStore) ExportStations(from string, to string, kioskId *int64, withBikes bool, fn func(ExportRow) error) error {
+	query := "SELECT updated_at, id, kiosk_id, name, latitude, longitude, total_docks, docks_available, bikes_available, classic_bikes_available, smart_bikes_available, electric_bikes_available, kiosk_status, kiosk_public_status FROM stations WHERE updated_at >= $1 AND updated_at <= $2 AND ($3::bigint IS NULL OR kiosk_id = $3) ORDER BY updated_at, id"
+	if withBikes {
+		query = "SELECT st.updated_at, st.kiosk_id, b.dock_number, b.is_electric, b.is_available, b.battery FROM stations as st INNER JOIN bikes b ON st.uid = b.station_id WHERE st.updated_at >= $1 AND st.updated_at <= $2 AND ($3::bigint IS NULL OR st.kiosk_id = $3) ORDER BY st.updated_at, st.id, b.dock_number"
+	}
+
+	rows, err := s.Db.Query(query, from, to, kioskId)
+	if err != nil {
+		return fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row ExportRow
+		if withBikes {
+			b := ExportBike{}
+			err = rows.Scan(&b.UpdatedAt, &b.KioskId, &b.DockNumber, &b.IsElectric, &b.IsAvailable, &b.Battery)
+			row = b
+		} else {
+			e := ExportStation{}
+			err = rows.Scan(&e.UpdatedAt, &e.Id, &e.KioskId, &e.Name, &e.Latitude, &e.Longitude, &e.TotalDocks, &e.DocksAvailable, &e.BikesAvailable, &e.ClassicBikesAvailable, &e.SmartBikesAvailable, &e.ElectricBikesAvailable, &e.KioskStatus, &e.KioskPublicStatus)
+			row = e
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
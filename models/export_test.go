@@ -0,0 +1,94 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetExportRowGroups(t *testing.T) {
+	var out bytes.Buffer
+	ew, err := NewExportWriter(&out, "parquet", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 2*parquetRowGroupRows + 1
+	for i := 0; i < total; i++ {
+		row := ExportStation{UpdatedAt: "2024-11-08 07:30:11", Id: int64(i), KioskId: 3005, Name: "Station", Latitude: 39.95, Longitude: -75.16, BikesAvailable: 3, KioskStatus: "FullService"}
+		if err := ew.Write(row); err != nil {
+			t.Fatal(err)
+		}
+		// the http handler flush every few hundred rows, it must not cut row groups
+		if err := ew.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Nil(t, ew.Close())
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(out.Bytes()), new(ExportStation), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	assert.Equal(t, int64(total), pr.GetNumRows())
+	assert.Len(t, pr.Footer.RowGroups, 3)
+
+	rows := make([]ExportStation, total)
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(total-1), rows[total-1].Id)
+	assert.Equal(t, "Station", rows[0].Name)
+	assert.Equal(t, 39.95, rows[0].Latitude)
+	assert.Equal(t, "FullService", rows[0].KioskStatus)
+}
+
+func TestParquetExportBikes(t *testing.T) {
+	var out bytes.Buffer
+	ew, err := NewExportWriter(&out, "parquet", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dock, electric := int64(4), true
+	assert.Nil(t, ew.Write(ExportBike{UpdatedAt: "2024-11-08 07:30:11", KioskId: 3005, Bike: Bike{DockNumber: &dock, IsElectric: &electric}}))
+	assert.Nil(t, ew.Close())
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(out.Bytes()), new(parquetBike), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	rows := make([]parquetBike, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, rows, 1)
+	assert.Equal(t, int64(3005), rows[0].KioskId)
+	assert.Equal(t, int64(4), *rows[0].DockNumber)
+	assert.True(t, *rows[0].IsElectric)
+	assert.Nil(t, rows[0].IsAvailable)
+	assert.Nil(t, rows[0].Battery)
+}
+
+func TestParquetExportEmpty(t *testing.T) {
+	var out bytes.Buffer
+	ew, err := NewExportWriter(&out, "parquet", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, ew.Close())
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(out.Bytes()), new(ExportStation), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	assert.Equal(t, int64(0), pr.GetNumRows())
+}
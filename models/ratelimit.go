@@ -0,0 +1,47 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// idle bucket older than this is full again and can be removed
+const rateLimitIdle = 24 * time.Hour
+
+func (s *PostgresStore) createRateLimitTable() error {
+	query := `CREATE TABLE IF NOT EXISTS rate_limits (
+		key VARCHAR(255) PRIMARY KEY,
+		tokens DOUBLE PRECISION NOT NULL,
+		allowed BOOLEAN NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL
+	)`
+
+	_, err := s.Db.Exec(query)
+	return err
+}
+
+// TakeRateLimitToken refill and take one token of the bucket in one statement so instances share the bucket
+func (s *PostgresStore) TakeRateLimitToken(key string, rate float64, burst int) (float64, bool, error) {
+	refilled := "LEAST($3::float8, rate_limits.tokens + EXTRACT(EPOCH FROM (clock_timestamp() - rate_limits.updated_at)) * $2::float8)"
+	query := `INSERT INTO rate_limits (key, tokens, allowed, updated_at) VALUES ($1, $3::float8 - 1, true, clock_timestamp())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE WHEN ` + refilled + ` >= 1 THEN ` + refilled + ` - 1 ELSE ` + refilled + ` END,
+			allowed = ` + refilled + ` >= 1,
+			updated_at = clock_timestamp()
+		RETURNING tokens, allowed`
+
+	var tokens float64
+	var allowed bool
+	if err := s.Db.QueryRow(query, key, rate, burst).Scan(&tokens, &allowed); err != nil {
+		return 0, false, fmt.Errorf("failed to take rate limit token: %v", err)
+	}
+	return tokens, allowed, nil
+}
+
+// PruneRateLimits remove buckets not used for a day
+func (s *PostgresStore) PruneRateLimits() error {
+	if _, err := s.Db.Exec("DELETE FROM rate_limits WHERE updated_at < $1", time.Now().Add(-rateLimitIdle)); err != nil {
+		return fmt.Errorf("failed to delete rate limits: %v", err)
+	}
+	return nil
+}
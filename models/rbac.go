@@ -0,0 +1,49 @@
+package models
+
+import "slices"
+
+const (
+	RoleViewer   = "viewer"
+	RoleAnalyst  = "analyst"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var Roles = []string{RoleViewer, RoleAnalyst, RoleOperator, RoleAdmin}
+
+// RolePermissions list the scopes granted to each role, admin is granted every scope
+var RolePermissions = map[string][]string{
+	RoleViewer:   {ScopeStationsRead, ScopeAlertsRead},
+	RoleAnalyst:  {ScopeStationsRead, ScopeAlertsRead, ScopeAnalyticsRead},
+	RoleOperator: {ScopeStationsRead, ScopeAlertsRead, ScopeAnalyticsRead, ScopeIngestWrite, ScopeAlertsWrite},
+	RoleAdmin:    {ScopeAdmin},
+}
+
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// RoleAllows return true when the role is granted the scope
+func RoleAllows(role string, scope string) bool {
+	perms := RolePermissions[role]
+	return slices.Contains(perms, scope) || slices.Contains(perms, ScopeAdmin)
+}
+
+// Permissions of a role narrowed to scopes when scopes is not empty, empty role return scopes as is
+func Permissions(role string, scopes []string) []string {
+	if role == "" {
+		return scopes
+	}
+	if len(scopes) == 0 {
+		return RolePermissions[role]
+	}
+
+	var perms []string
+	for _, scope := range scopes {
+		if RoleAllows(role, scope) {
+			perms = append(perms, scope)
+		}
+	}
+	return perms
+}
@@ -4,36 +4,81 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"sort"
 	"time"
 
+	"github.com/waiwen1001/bike/config"
+
 	_ "github.com/lib/pq"
 )
 
 type Storage interface {
 	StoreIndegoData(*IndegoRes) error
-	GetStationList(string) ([]BikeResult, error)
+	GetStationList(string, Page) ([]BikeResult, error)
 	GetStation(string, string) (BikeResult, error)
+	ExportStations(string, string, *int64, bool, func(ExportRow) error) error
+	GetLastUpdated() (string, error)
+	DeleteSnapshotsBefore(string) (int64, error)
+	StoreWeatherObservations(string, []WeatherObservation) error
+	GetNearestWeather(string, []string) (map[string]WeatherObservation, error)
+	GetSnapshotTimes(string, string) ([]string, error)
+	GetStationPositions(string) ([]Properties, error)
+	GetWeatherCells(string) (map[string]bool, error)
+	GetWeatherObservations(string, string) ([]WeatherObservation, error)
+
+	CreateAlertRule(*AlertRule) error
+	GetAlertRules(Page) ([]AlertRule, error)
+	GetAlertRule(int64) (AlertRule, error)
+	UpdateAlertRule(*AlertRule) error
+	DeleteAlertRule(int64) error
+	GetAlertStates(int64) (map[int64]AlertState, error)
+	SaveAlertState(AlertState) error
+	DeleteAlertState(int64, int64) error
+	CreateAlertDelivery(*AlertDelivery) error
+	UpdateAlertDelivery(*AlertDelivery) error
+	GetAlertDeliveries(int64, Page) ([]AlertDelivery, error)
+
+	CreateUser(*User) error
+	GetUserByUsername(string) (User, error)
+	UpsertOIDCUser(string, string) (User, error)
+	CreateSession(*Session) error
+	GetSessionUser(string) (User, error)
+	DeleteSession(string) error
+
+	CreateAPIKey(*APIKey) error
+	GetAPIKeys(Page) ([]APIKey, error)
+	GetAPIKeyByHash(string) (APIKey, error)
+	TouchAPIKey(int64) error
+	RevokeAPIKey(int64) error
+
+	TakeRateLimitToken(string, float64, int) (float64, bool, error)
+	PruneRateLimits() error
+
+	CreateAuditEvent(*AuditEvent) error
+	GetAuditEvents(AuditFilter, Page) ([]AuditEvent, error)
+
+	Ping(context.Context) error
+	GetSchemaVersion() (int, error)
 }
 
 type PostgresStore struct {
 	Db *sql.DB
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-
-	connStr := fmt.Sprintf("user=%v dbname=%v password=%v sslmode=disable", dbUser, dbName, dbPassword)
-	db, err := sql.Open("postgres", connStr)
+func NewPostgresStore(c config.Database) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", c.DSN())
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+
+	if err := ping(db, c.ConnectTimeout, c.ConnectRetry); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -42,21 +87,113 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}, nil
 }
 
+func (s *PostgresStore) Close() error {
+	return s.Db.Close()
+}
+
+// ping retry with backoff until the database is reachable or retry duration is over,
+// eg. when the app start before the database container
+func ping(db *sql.DB, timeout time.Duration, retry time.Duration) error {
+	deadline := time.Now().Add(retry)
+	wait := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("database not reachable: %v", err)
+		}
+
+		slog.Warn("Database not reachable", "retry", wait, "err", err)
+		time.Sleep(wait)
+		wait = min(wait*2, 10*time.Second)
+	}
+}
+
 // table migration
 func (s *PostgresStore) Init() error {
 	if err := s.createStationTable(); err != nil {
-		log.Printf("Station table err")
+		slog.Error("Station table err", "err", err)
 		return err
 	}
 
 	if err := s.createBikeTable(); err != nil {
-		log.Printf("Station bike err")
+		slog.Error("Station bike err", "err", err)
+		return err
+	}
+
+	if err := s.createWeatherTable(); err != nil {
+		slog.Error("Weather table err", "err", err)
+		return err
+	}
+
+	if err := s.createAlertTables(); err != nil {
+		slog.Error("Alert table err", "err", err)
+		return err
+	}
+
+	if err := s.createUserTables(); err != nil {
+		slog.Error("User table err", "err", err)
+		return err
+	}
+
+	if err := s.createAPIKeyTable(); err != nil {
+		slog.Error("API key table err", "err", err)
+		return err
+	}
+
+	if err := s.createRateLimitTable(); err != nil {
+		slog.Error("Rate limit table err", "err", err)
+		return err
+	}
+
+	if err := s.createAuditTable(); err != nil {
+		slog.Error("Audit table err", "err", err)
+		return err
+	}
+
+	if err := s.recordSchemaVersion(); err != nil {
+		slog.Error("Schema migrations table err", "err", err)
 		return err
 	}
 
 	return nil
 }
 
+// SchemaVersion is recorded after Init succeed, bump it when Init add a table or column
+const SchemaVersion = 1
+
+func (s *PostgresStore) recordSchemaVersion() error {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.Db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING", SchemaVersion, time.Now())
+	return err
+}
+
+// GetSchemaVersion return the highest version recorded by Init, 0 when Init never completed
+func (s *PostgresStore) GetSchemaVersion() (int, error) {
+	var version int
+	if err := s.Db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to select query: %v", err)
+	}
+	return version, nil
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
+}
+
 func (s *PostgresStore) createStationTable() error {
 	query := `CREATE TABLE IF NOT EXISTS stations (
 		uid SERIAL PRIMARY KEY,
@@ -169,7 +306,6 @@ func (s *PostgresStore) StoreIndegoData(data *IndegoRes) error {
 	_, err = tx.Exec(query, values...)
 	if err != nil {
 		tx.Rollback()
-		log.Printf("Station Query execute error %v", err)
 		return fmt.Errorf("failed to execute station bulk insert: %v", err)
 	}
 
@@ -179,7 +315,6 @@ func (s *PostgresStore) StoreIndegoData(data *IndegoRes) error {
 
 	if err != nil {
 		tx.Rollback()
-		log.Printf("Query select error %v", err)
 		return fmt.Errorf("failed to select query: %v", err)
 	}
 	defer rows.Close()
@@ -189,7 +324,6 @@ func (s *PostgresStore) StoreIndegoData(data *IndegoRes) error {
 		mp := MinProperties{}
 		if err := rows.Scan(&mp.Uid, &mp.KioskId, &mp.UpdatedAt); err != nil {
 			tx.Rollback()
-			log.Printf("Station scan error %v", err)
 			return fmt.Errorf("failed to scan row: %v", err)
 		}
 
@@ -219,27 +353,32 @@ func (s *PostgresStore) StoreIndegoData(data *IndegoRes) error {
 	_, err = tx.Exec(bQuery, bValues...)
 	if err != nil {
 		tx.Rollback()
-		log.Printf("Bike Query execute error %v", err)
 		return fmt.Errorf("failed to execute bike bulk insert: %v", err)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		log.Printf("Query transaction commit error %v", err)
 		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	return nil
 }
 
-func (s *PostgresStore) GetStationList(at string) (res []BikeResult, err error) {
+func (s *PostgresStore) GetStationList(at string, page Page) (res []BikeResult, err error) {
 	atFrom := fmt.Sprintf("%v.000", at)
 	atTo := fmt.Sprintf("%v.999", at)
-	query := "SELECT st.*, b.dock_number, b.is_electric, b.is_available, b.battery FROM stations as st LEFT JOIN bikes b ON st.uid = b.station_id WHERE st.updated_at >= $1 AND st.updated_at <= $2"
-	rows, err := s.Db.Query(query, atFrom, atTo)
+
+	// limit NULL mean no limit in postgres
+	var limit any
+	if page.Limit > 0 {
+		limit = page.Limit
+	}
+
+	// paginate stations first, then join bikes so the limit count stations instead of bike rows
+	query := "SELECT st.*, b.dock_number, b.is_electric, b.is_available, b.battery FROM (SELECT * FROM stations WHERE updated_at >= $1 AND updated_at <= $2 AND id > $3 ORDER BY id LIMIT $4) as st LEFT JOIN bikes b ON st.uid = b.station_id"
+	rows, err := s.Db.Query(query, atFrom, atTo, page.AfterId, limit)
 
 	if err != nil {
-		log.Printf("Query select error %v", err)
 		return nil, fmt.Errorf("failed to select query: %v", err)
 	}
 	defer rows.Close()
@@ -253,7 +392,6 @@ func (s *PostgresStore) GetStationList(at string) (res []BikeResult, err error)
 		b := Bike{}
 		var uid int64
 		if err := rows.Scan(&uid, &p.Id, &p.Name, &p.Latitude, &p.Longitude, &p.GeometryType, &p.TotalDocks, &p.DocksAvailable, &p.BikesAvailable, &p.ClassicBikesAvailable, &p.SmartBikesAvailable, &p.ElectricBikesAvailable, &p.RewardBikesAvailable, &p.RewardDocksAvailable, &p.KioskStatus, &p.KioskPublicStatus, &p.KioskConnectionStatus, &p.KioskType, &p.AddressStreet, &p.AddressCity, &p.AddressState, &p.AddressZipCode, &p.OpenTime, &p.CloseTime, &p.EventStart, &p.EventEnd, &p.IsEventBased, &p.IsVirtual, &p.KioskId, &p.Notes, &p.PublicText, &p.TimeZone, &p.TrikesAvailable, &p.StationType, &p.UpdatedAt, &p.CreatedAt, &b.DockNumber, &b.IsElectric, &b.IsAvailable, &b.Battery); err != nil {
-			log.Printf("Station scan error %v", err)
 			return nil, fmt.Errorf("failed to scan row: %v", err)
 		}
 
@@ -261,7 +399,6 @@ func (s *PostgresStore) GetStationList(at string) (res []BikeResult, err error)
 		if _, exists := fMap[uid]; !exists {
 			err := s.ConvertDBProperties(p, &f)
 			if err != nil {
-				log.Printf("Convert properties error %v", err)
 				return nil, fmt.Errorf("failed to convert properties: %v", err)
 			}
 
@@ -304,7 +441,6 @@ func (s *PostgresStore) GetStation(at string, kioskId string) (res BikeResult, e
 	rows, err := s.Db.Query(query, kioskId, atFrom, atTo)
 
 	if err != nil {
-		log.Printf("Query select error %v", err)
 		return BikeResult{}, fmt.Errorf("failed to select query: %v", err)
 	}
 	defer rows.Close()
@@ -316,7 +452,6 @@ func (s *PostgresStore) GetStation(at string, kioskId string) (res BikeResult, e
 		p := DbProperties{}
 		b := Bike{}
 		if err := rows.Scan(&p.Uid, &p.Id, &p.Name, &p.Latitude, &p.Longitude, &p.GeometryType, &p.TotalDocks, &p.DocksAvailable, &p.BikesAvailable, &p.ClassicBikesAvailable, &p.SmartBikesAvailable, &p.ElectricBikesAvailable, &p.RewardBikesAvailable, &p.RewardDocksAvailable, &p.KioskStatus, &p.KioskPublicStatus, &p.KioskConnectionStatus, &p.KioskType, &p.AddressStreet, &p.AddressCity, &p.AddressState, &p.AddressZipCode, &p.OpenTime, &p.CloseTime, &p.EventStart, &p.EventEnd, &p.IsEventBased, &p.IsVirtual, &p.KioskId, &p.Notes, &p.PublicText, &p.TimeZone, &p.TrikesAvailable, &p.StationType, &p.UpdatedAt, &p.CreatedAt, &b.DockNumber, &b.IsElectric, &b.IsAvailable, &b.Battery); err != nil {
-			log.Printf("Station scan error %v", err)
 			return BikeResult{}, fmt.Errorf("failed to scan row: %v", err)
 		}
 
@@ -324,7 +459,6 @@ func (s *PostgresStore) GetStation(at string, kioskId string) (res BikeResult, e
 			// only update when first time
 			err = s.ConvertDBProperties(p, &f)
 			if err != nil {
-				log.Printf("Convert properties error %v", err)
 				return BikeResult{}, fmt.Errorf("failed to convert properties: %v", err)
 			}
 		}
@@ -344,6 +478,51 @@ func (s *PostgresStore) GetStation(at string, kioskId string) (res BikeResult, e
 	return
 }
 
+// GetLastUpdated return the latest snapshot time, empty when no snapshot stored yet
+func (s *PostgresStore) GetLastUpdated() (string, error) {
+	var lastUpdated *time.Time
+	if err := s.Db.QueryRow("SELECT MAX(updated_at) FROM stations").Scan(&lastUpdated); err != nil {
+		return "", fmt.Errorf("failed to select query: %v", err)
+	}
+
+	if lastUpdated == nil {
+		return "", nil
+	}
+
+	return lastUpdated.Format("2006-01-02 15:04:05"), nil
+}
+
+// DeleteSnapshotsBefore remove stations, bikes and weather observations of snapshots older than before, return deleted station rows
+func (s *PostgresStore) DeleteSnapshotsBefore(before string) (int64, error) {
+	tx, err := s.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM bikes WHERE station_id IN (SELECT uid FROM stations WHERE updated_at < $1)", before); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to delete bikes: %v", err)
+	}
+
+	res, err := tx.Exec("DELETE FROM stations WHERE updated_at < $1", before)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to delete stations: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM weather_observations WHERE snapshot_at < $1", before); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to delete weather observations: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
 func (s *PostgresStore) ConvertDBProperties(dbp DbProperties, f *Feature) (err error) {
 	p := Properties{}
 	p.Id = dbp.Id
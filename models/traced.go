@@ -0,0 +1,232 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/waiwen1001/bike/tracing"
+)
+
+// tracedStorage record a span of each method as child of the span in ctx
+type tracedStorage struct {
+	Storage
+	ctx context.Context
+}
+
+// Traced return store recording spans under ctx, handlers wrap the store with the request context
+func Traced(ctx context.Context, store Storage) Storage {
+	return tracedStorage{Storage: store, ctx: ctx}
+}
+
+// observe start the span of method, the returned func end it and log a failure with the request id and trace of ctx
+func observe(ctx context.Context, method string) func(*error) {
+	end := tracing.StoreSpan(ctx, method)
+	return func(err *error) {
+		end(err)
+		// not found is an answer of the query, callers decide whether it is an error
+		if *err != nil && !strings.Contains((*err).Error(), "empty row") {
+			slog.ErrorContext(ctx, "Storage error", "method", method, "err", *err)
+		}
+	}
+}
+
+func (t tracedStorage) StoreIndegoData(data *IndegoRes) (err error) {
+	defer observe(t.ctx, "StoreIndegoData")(&err)
+	return t.Storage.StoreIndegoData(data)
+}
+
+func (t tracedStorage) GetStationList(at string, page Page) (res []BikeResult, err error) {
+	defer observe(t.ctx, "GetStationList")(&err)
+	return t.Storage.GetStationList(at, page)
+}
+
+func (t tracedStorage) GetStation(at string, kioskId string) (res BikeResult, err error) {
+	defer observe(t.ctx, "GetStation")(&err)
+	return t.Storage.GetStation(at, kioskId)
+}
+
+func (t tracedStorage) ExportStations(from string, to string, kioskId *int64, withBikes bool, fn func(ExportRow) error) (err error) {
+	defer observe(t.ctx, "ExportStations")(&err)
+	return t.Storage.ExportStations(from, to, kioskId, withBikes, fn)
+}
+
+func (t tracedStorage) GetLastUpdated() (res string, err error) {
+	defer observe(t.ctx, "GetLastUpdated")(&err)
+	return t.Storage.GetLastUpdated()
+}
+
+func (t tracedStorage) DeleteSnapshotsBefore(before string) (res int64, err error) {
+	defer observe(t.ctx, "DeleteSnapshotsBefore")(&err)
+	return t.Storage.DeleteSnapshotsBefore(before)
+}
+
+func (t tracedStorage) StoreWeatherObservations(snapshotAt string, obs []WeatherObservation) (err error) {
+	defer observe(t.ctx, "StoreWeatherObservations")(&err)
+	return t.Storage.StoreWeatherObservations(snapshotAt, obs)
+}
+
+func (t tracedStorage) GetNearestWeather(at string, cells []string) (res map[string]WeatherObservation, err error) {
+	defer observe(t.ctx, "GetNearestWeather")(&err)
+	return t.Storage.GetNearestWeather(at, cells)
+}
+
+func (t tracedStorage) GetSnapshotTimes(from string, to string) (res []string, err error) {
+	defer observe(t.ctx, "GetSnapshotTimes")(&err)
+	return t.Storage.GetSnapshotTimes(from, to)
+}
+
+func (t tracedStorage) GetStationPositions(at string) (res []Properties, err error) {
+	defer observe(t.ctx, "GetStationPositions")(&err)
+	return t.Storage.GetStationPositions(at)
+}
+
+func (t tracedStorage) GetWeatherCells(at string) (res map[string]bool, err error) {
+	defer observe(t.ctx, "GetWeatherCells")(&err)
+	return t.Storage.GetWeatherCells(at)
+}
+
+func (t tracedStorage) GetWeatherObservations(from string, to string) (res []WeatherObservation, err error) {
+	defer observe(t.ctx, "GetWeatherObservations")(&err)
+	return t.Storage.GetWeatherObservations(from, to)
+}
+
+func (t tracedStorage) CreateAlertRule(a *AlertRule) (err error) {
+	defer observe(t.ctx, "CreateAlertRule")(&err)
+	return t.Storage.CreateAlertRule(a)
+}
+
+func (t tracedStorage) GetAlertRules(page Page) (res []AlertRule, err error) {
+	defer observe(t.ctx, "GetAlertRules")(&err)
+	return t.Storage.GetAlertRules(page)
+}
+
+func (t tracedStorage) GetAlertRule(id int64) (res AlertRule, err error) {
+	defer observe(t.ctx, "GetAlertRule")(&err)
+	return t.Storage.GetAlertRule(id)
+}
+
+func (t tracedStorage) UpdateAlertRule(a *AlertRule) (err error) {
+	defer observe(t.ctx, "UpdateAlertRule")(&err)
+	return t.Storage.UpdateAlertRule(a)
+}
+
+func (t tracedStorage) DeleteAlertRule(id int64) (err error) {
+	defer observe(t.ctx, "DeleteAlertRule")(&err)
+	return t.Storage.DeleteAlertRule(id)
+}
+
+func (t tracedStorage) GetAlertStates(ruleId int64) (res map[int64]AlertState, err error) {
+	defer observe(t.ctx, "GetAlertStates")(&err)
+	return t.Storage.GetAlertStates(ruleId)
+}
+
+func (t tracedStorage) SaveAlertState(st AlertState) (err error) {
+	defer observe(t.ctx, "SaveAlertState")(&err)
+	return t.Storage.SaveAlertState(st)
+}
+
+func (t tracedStorage) DeleteAlertState(ruleId int64, kioskId int64) (err error) {
+	defer observe(t.ctx, "DeleteAlertState")(&err)
+	return t.Storage.DeleteAlertState(ruleId, kioskId)
+}
+
+func (t tracedStorage) CreateAlertDelivery(d *AlertDelivery) (err error) {
+	defer observe(t.ctx, "CreateAlertDelivery")(&err)
+	return t.Storage.CreateAlertDelivery(d)
+}
+
+func (t tracedStorage) UpdateAlertDelivery(d *AlertDelivery) (err error) {
+	defer observe(t.ctx, "UpdateAlertDelivery")(&err)
+	return t.Storage.UpdateAlertDelivery(d)
+}
+
+func (t tracedStorage) GetAlertDeliveries(ruleId int64, page Page) (res []AlertDelivery, err error) {
+	defer observe(t.ctx, "GetAlertDeliveries")(&err)
+	return t.Storage.GetAlertDeliveries(ruleId, page)
+}
+
+func (t tracedStorage) CreateUser(u *User) (err error) {
+	defer observe(t.ctx, "CreateUser")(&err)
+	return t.Storage.CreateUser(u)
+}
+
+func (t tracedStorage) GetUserByUsername(username string) (res User, err error) {
+	defer observe(t.ctx, "GetUserByUsername")(&err)
+	return t.Storage.GetUserByUsername(username)
+}
+
+func (t tracedStorage) UpsertOIDCUser(subject string, username string) (res User, err error) {
+	defer observe(t.ctx, "UpsertOIDCUser")(&err)
+	return t.Storage.UpsertOIDCUser(subject, username)
+}
+
+func (t tracedStorage) CreateSession(sess *Session) (err error) {
+	defer observe(t.ctx, "CreateSession")(&err)
+	return t.Storage.CreateSession(sess)
+}
+
+func (t tracedStorage) GetSessionUser(token string) (res User, err error) {
+	defer observe(t.ctx, "GetSessionUser")(&err)
+	return t.Storage.GetSessionUser(token)
+}
+
+func (t tracedStorage) DeleteSession(token string) (err error) {
+	defer observe(t.ctx, "DeleteSession")(&err)
+	return t.Storage.DeleteSession(token)
+}
+
+func (t tracedStorage) CreateAPIKey(k *APIKey) (err error) {
+	defer observe(t.ctx, "CreateAPIKey")(&err)
+	return t.Storage.CreateAPIKey(k)
+}
+
+func (t tracedStorage) GetAPIKeys(page Page) (res []APIKey, err error) {
+	defer observe(t.ctx, "GetAPIKeys")(&err)
+	return t.Storage.GetAPIKeys(page)
+}
+
+func (t tracedStorage) GetAPIKeyByHash(keyHash string) (res APIKey, err error) {
+	defer observe(t.ctx, "GetAPIKeyByHash")(&err)
+	return t.Storage.GetAPIKeyByHash(keyHash)
+}
+
+func (t tracedStorage) TouchAPIKey(id int64) (err error) {
+	defer observe(t.ctx, "TouchAPIKey")(&err)
+	return t.Storage.TouchAPIKey(id)
+}
+
+func (t tracedStorage) RevokeAPIKey(id int64) (err error) {
+	defer observe(t.ctx, "RevokeAPIKey")(&err)
+	return t.Storage.RevokeAPIKey(id)
+}
+
+func (t tracedStorage) TakeRateLimitToken(key string, rate float64, burst int) (res float64, r1 bool, err error) {
+	defer observe(t.ctx, "TakeRateLimitToken")(&err)
+	return t.Storage.TakeRateLimitToken(key, rate, burst)
+}
+
+func (t tracedStorage) PruneRateLimits() (err error) {
+	defer observe(t.ctx, "PruneRateLimits")(&err)
+	return t.Storage.PruneRateLimits()
+}
+
+func (t tracedStorage) CreateAuditEvent(e *AuditEvent) (err error) {
+	defer observe(t.ctx, "CreateAuditEvent")(&err)
+	return t.Storage.CreateAuditEvent(e)
+}
+
+func (t tracedStorage) GetAuditEvents(filter AuditFilter, page Page) (res []AuditEvent, err error) {
+	defer observe(t.ctx, "GetAuditEvents")(&err)
+	return t.Storage.GetAuditEvents(filter, page)
+}
+
+func (t tracedStorage) GetSchemaVersion() (res int, err error) {
+	defer observe(t.ctx, "GetSchemaVersion")(&err)
+	return t.Storage.GetSchemaVersion()
+}
+
+func (t tracedStorage) Ping(ctx context.Context) (err error) {
+	defer observe(ctx, "Ping")(&err)
+	return t.Storage.Ping(ctx)
+}
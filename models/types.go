@@ -87,10 +87,38 @@ type MinProperties struct {
 	UpdatedAt string
 }
 
+// Page is the cursor position for list queries, AfterId is the last id returned by previous page
+type Page struct {
+	AfterId int64
+	Limit   int
+}
+
 type BikeResult struct {
 	At       string  `json:"at"`
 	Stations Feature `json:"stations"`
 	Weather  Weather `json:"weather"`
+	// WeatherStatus is ok, stale or unavailable
+	WeatherStatus string `json:"weatherStatus"`
+}
+
+// FeatureCollection is the GeoJSON (RFC 7946) form of station list, Next is a foreign member for pagination
+type FeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []GeoFeature `json:"features"`
+	Next     string       `json:"next,omitempty"`
+}
+
+type GeoFeature struct {
+	Type       string        `json:"type"`
+	Geometry   Geometry      `json:"geometry"`
+	Properties GeoProperties `json:"properties"`
+}
+
+type GeoProperties struct {
+	Properties
+	StationType string  `json:"stationType"`
+	At          string  `json:"at"`
+	Weather     Weather `json:"weather"`
 }
 
 type Weather struct {
@@ -109,9 +137,104 @@ type Weather struct {
 	Cod        int64         `json:"cod"`
 }
 
-type WeatherResult struct {
-	Weather
-	Index int
+// WeatherReport is the provider independent weather model, units are metric (celsius, m/s, hPa, mm)
+type WeatherReport struct {
+	Provider      string    `json:"provider"`
+	ObservedAt    time.Time `json:"observedAt"`
+	Latitude      float64   `json:"latitude"`
+	Longitude     float64   `json:"longitude"`
+	Temp          float64   `json:"temp"`
+	FeelsLike     float64   `json:"feelsLike"`
+	Humidity      float64   `json:"humidity"`
+	Pressure      float64   `json:"pressure"`
+	WindSpeed     float64   `json:"windSpeed"`
+	WindDeg       int64     `json:"windDeg"`
+	WindGust      float64   `json:"windGust"`
+	Clouds        int64     `json:"clouds"`
+	Precipitation float64   `json:"precipitation"`
+	Visibility    int64     `json:"visibility"`
+	// Condition use open weather "main" group names, eg. Clear, Clouds, Rain, Snow
+	Condition   string `json:"condition"`
+	Description string `json:"description"`
+
+	// only supplied by open weather, empty for other providers
+	TempMin     *float64 `json:"tempMin,omitempty"`
+	TempMax     *float64 `json:"tempMax,omitempty"`
+	SeaLevel    float64  `json:"seaLevel,omitempty"`
+	GrndLevel   float64  `json:"grndLevel,omitempty"`
+	ConditionId int64    `json:"conditionId,omitempty"`
+	Icon        string   `json:"icon,omitempty"`
+	CityId      int64    `json:"cityId,omitempty"`
+	City        string   `json:"city,omitempty"`
+	Country     string   `json:"country,omitempty"`
+	Sunrise     int64    `json:"sunrise,omitempty"`
+	Sunset      int64    `json:"sunset,omitempty"`
+	// Timezone is the utc offset in seconds
+	Timezone int64 `json:"timezone,omitempty"`
+}
+
+const kelvin = 273.15
+
+// WeatherReportFromOWM convert an open weather current response, tempOffset is added to its temperatures to get celsius
+func WeatherReportFromOWM(w Weather, tempOffset float64) WeatherReport {
+	tempMin, tempMax := w.Main.TempMin+tempOffset, w.Main.TempMax+tempOffset
+	r := WeatherReport{
+		ObservedAt: time.Unix(w.Dt, 0).UTC(),
+		Latitude:   w.Coord.Lat,
+		Longitude:  w.Coord.Lon,
+		Temp:       w.Main.Temp + tempOffset,
+		FeelsLike:  w.Main.FeelsLike + tempOffset,
+		Humidity:   w.Main.Humidity,
+		Pressure:   w.Main.Pressure,
+		WindSpeed:  w.Wind.Speed,
+		WindDeg:    w.Wind.Deg,
+		WindGust:   w.Wind.Gust,
+		Clouds:     w.Clouds.All,
+		Visibility: w.Visibility,
+		TempMin:    &tempMin,
+		TempMax:    &tempMax,
+		SeaLevel:   w.Main.SeaLevel,
+		GrndLevel:  w.Main.GrndLevel,
+		CityId:     w.Id,
+		City:       w.Name,
+		Country:    w.Sys.Country,
+		Sunrise:    w.Sys.Sunrise,
+		Sunset:     w.Sys.Sunset,
+		Timezone:   w.Timezone,
+	}
+	if len(w.Weather) > 0 {
+		r.Condition = w.Weather[0].Main
+		r.Description = w.Weather[0].Description
+		r.ConditionId = w.Weather[0].Id
+		r.Icon = w.Weather[0].Icon
+	}
+	return r
+}
+
+// ToWeather convert to the api response shape, temperature in kelvin as open weather default.
+// Without min and max of the provider both are the current temperature.
+func (r WeatherReport) ToWeather() Weather {
+	w := Weather{
+		Coord:      WeatherCoord{Lon: r.Longitude, Lat: r.Latitude},
+		Weather:    []WeatherInfo{{Id: r.ConditionId, Main: r.Condition, Description: r.Description, Icon: r.Icon}},
+		Base:       r.Provider,
+		Main:       WeatherMain{Temp: r.Temp + kelvin, FeelsLike: r.FeelsLike + kelvin, TempMin: r.Temp + kelvin, TempMax: r.Temp + kelvin, Pressure: r.Pressure, Humidity: r.Humidity, SeaLevel: r.SeaLevel, GrndLevel: r.GrndLevel},
+		Visibility: r.Visibility,
+		Wind:       WeatherWind{Speed: r.WindSpeed, Deg: r.WindDeg, Gust: r.WindGust},
+		Clouds:     WeatherCloud{All: r.Clouds},
+		Dt:         r.ObservedAt.Unix(),
+		Sys:        WeatherSys{Country: r.Country, Sunrise: r.Sunrise, Sunset: r.Sunset},
+		Timezone:   r.Timezone,
+		Id:         r.CityId,
+		Name:       r.City,
+	}
+	if r.TempMin != nil {
+		w.Main.TempMin = *r.TempMin + kelvin
+	}
+	if r.TempMax != nil {
+		w.Main.TempMax = *r.TempMax + kelvin
+	}
+	return w
 }
 
 type WeatherCoord struct {
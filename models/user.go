@@ -0,0 +1,137 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+type User struct {
+	Id           int64     `json:"id"`
+	Username     string    `json:"username"`
+	Role         string    `json:"role"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Session is one login of a user, only the hash of the token is stored
+type Session struct {
+	Token     string
+	UserId    int64
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (s *PostgresStore) createUserTables() error {
+	query := `CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(255) NOT NULL UNIQUE,
+		password_hash VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	// users login with an identity provider have empty password_hash
+	if _, err := s.Db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject VARCHAR(255) UNIQUE`); err != nil {
+		return err
+	}
+
+	if _, err := s.Db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(50) NOT NULL DEFAULT 'viewer'`); err != nil {
+		return err
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS sessions (
+		token_hash VARCHAR(64) PRIMARY KEY,
+		user_id INT REFERENCES users(id) ON DELETE CASCADE,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.Db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions (expires_at)`)
+	return err
+}
+
+// HashToken return sha256 hex of a session token, a leaked table cannot be used to login
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *PostgresStore) CreateUser(u *User) error {
+	u.CreatedAt = time.Now()
+	if u.Role == "" {
+		u.Role = RoleViewer
+	}
+	query := "INSERT INTO users (username, password_hash, role, created_at) VALUES ($1, $2, $3, $4) RETURNING id"
+	if err := s.Db.QueryRow(query, u.Username, u.PasswordHash, u.Role, u.CreatedAt).Scan(&u.Id); err != nil {
+		return fmt.Errorf("failed to insert user: %v", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetUserByUsername(username string) (User, error) {
+	u := User{}
+	err := s.Db.QueryRow("SELECT id, username, role, password_hash, created_at FROM users WHERE username = $1", username).Scan(&u.Id, &u.Username, &u.Role, &u.PasswordHash, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return u, fmt.Errorf("empty row")
+	}
+	if err != nil {
+		return u, fmt.Errorf("failed to select query: %v", err)
+	}
+	return u, nil
+}
+
+// UpsertOIDCUser return the user linked to the identity provider subject, created on first login as viewer
+func (s *PostgresStore) UpsertOIDCUser(subject string, username string) (User, error) {
+	u := User{}
+	query := `INSERT INTO users (username, password_hash, oidc_subject, created_at) VALUES ($1, '', $2, $3)
+		ON CONFLICT (oidc_subject) DO UPDATE SET username = EXCLUDED.username
+		RETURNING id, username, role, password_hash, created_at`
+	err := s.Db.QueryRow(query, username, subject, time.Now()).Scan(&u.Id, &u.Username, &u.Role, &u.PasswordHash, &u.CreatedAt)
+	if err != nil {
+		return u, fmt.Errorf("failed to upsert user: %v", err)
+	}
+	return u, nil
+}
+
+func (s *PostgresStore) CreateSession(sess *Session) error {
+	sess.CreatedAt = time.Now()
+	query := "INSERT INTO sessions (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)"
+	if _, err := s.Db.Exec(query, HashToken(sess.Token), sess.UserId, sess.ExpiresAt, sess.CreatedAt); err != nil {
+		return fmt.Errorf("failed to insert session: %v", err)
+	}
+	return nil
+}
+
+// GetSessionUser return the user of an unexpired session token
+func (s *PostgresStore) GetSessionUser(token string) (User, error) {
+	u := User{}
+	query := `SELECT u.id, u.username, u.role, u.password_hash, u.created_at FROM sessions s
+		INNER JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > $2`
+	err := s.Db.QueryRow(query, HashToken(token), time.Now()).Scan(&u.Id, &u.Username, &u.Role, &u.PasswordHash, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return u, fmt.Errorf("empty row")
+	}
+	if err != nil {
+		return u, fmt.Errorf("failed to select query: %v", err)
+	}
+	return u, nil
+}
+
+// DeleteSession remove the session token, expired sessions are removed at the same time
+func (s *PostgresStore) DeleteSession(token string) error {
+	if _, err := s.Db.Exec("DELETE FROM sessions WHERE token_hash = $1 OR expires_at <= $2", HashToken(token), time.Now()); err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
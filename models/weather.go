@@ -0,0 +1,235 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WeatherMatchWindow is the furthest stored observation from the snapshot that is used
+const WeatherMatchWindow = 3 * time.Hour
+
+// WeatherObservation is the weather of one grid cell captured at snapshot ingest
+type WeatherObservation struct {
+	SnapshotAt string
+	Cell       string
+	Latitude   float64
+	Longitude  float64
+	ObservedAt time.Time
+	Report     WeatherReport
+}
+
+func (s *PostgresStore) createWeatherTable() error {
+	query := `CREATE TABLE IF NOT EXISTS weather_observations (
+		uid SERIAL PRIMARY KEY,
+		snapshot_at TIMESTAMP NOT NULL,
+		cell VARCHAR(50) NOT NULL,
+		latitude DOUBLE PRECISION,
+		longitude DOUBLE PRECISION,
+		observed_at TIMESTAMP,
+		data JSONB,
+		created_at TIMESTAMP,
+		UNIQUE (cell, snapshot_at)
+	)`
+
+	if _, err := s.Db.Exec(query); err != nil {
+		return err
+	}
+
+	_, err := s.Db.Exec(`CREATE INDEX IF NOT EXISTS idx_weather_snapshot_at ON weather_observations (snapshot_at)`)
+	return err
+}
+
+// StoreWeatherObservations save weather of each cell for the snapshot, existing cell of same snapshot is replaced
+func (s *PostgresStore) StoreWeatherObservations(snapshotAt string, obs []WeatherObservation) error {
+	if len(obs) == 0 {
+		return nil
+	}
+
+	tx, err := s.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO weather_observations (snapshot_at, cell, latitude, longitude, observed_at, data, created_at) VALUES `
+	var values []interface{}
+	for i, o := range obs {
+		data, err := json.Marshal(o.Report)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if i > 0 {
+			query += ", "
+		}
+
+		qi := i * 7
+		query += fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", qi+1, qi+2, qi+3, qi+4, qi+5, qi+6, qi+7)
+		values = append(values, snapshotAt, o.Cell, o.Latitude, o.Longitude, o.ObservedAt, string(data), time.Now())
+	}
+	query += " ON CONFLICT (cell, snapshot_at) DO UPDATE SET observed_at = EXCLUDED.observed_at, data = EXCLUDED.data"
+
+	if _, err := tx.Exec(query, values...); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to execute weather bulk insert: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// parseWeatherData read a stored report. Rows captured before weather providers hold the open weather response
+// in kelvin instead, they are converted so old snapshots keep their weather.
+func parseWeatherData(data []byte) (WeatherReport, error) {
+	var probe struct {
+		Provider string `json:"provider"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return WeatherReport{}, err
+	}
+
+	var r WeatherReport
+	if probe.Provider != "" {
+		err := json.Unmarshal(data, &r)
+		return r, err
+	}
+
+	var w Weather
+	if err := json.Unmarshal(data, &w); err != nil {
+		return r, err
+	}
+	r = WeatherReportFromOWM(w, -kelvin)
+	r.Provider = "openweathermap"
+	return r, nil
+}
+
+// GetNearestWeather return for each cell the stored observation nearest to at
+func (s *PostgresStore) GetNearestWeather(at string, cells []string) (map[string]WeatherObservation, error) {
+	res := make(map[string]WeatherObservation)
+	if len(cells) == 0 {
+		return res, nil
+	}
+
+	query := `SELECT DISTINCT ON (cell) snapshot_at, cell, latitude, longitude, observed_at, data FROM weather_observations
+		WHERE cell = ANY($1) AND snapshot_at BETWEEN $2::timestamp - $3::interval AND $2::timestamp + $3::interval
+		ORDER BY cell, ABS(EXTRACT(EPOCH FROM (snapshot_at - $2::timestamp)))`
+	window := fmt.Sprintf("%d seconds", int64(WeatherMatchWindow.Seconds()))
+	rows, err := s.Db.Query(query, pq.Array(cells), at, window)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o := WeatherObservation{}
+		var snapshotAt time.Time
+		var data []byte
+		if err := rows.Scan(&snapshotAt, &o.Cell, &o.Latitude, &o.Longitude, &o.ObservedAt, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+
+		if o.Report, err = parseWeatherData(data); err != nil {
+			return nil, fmt.Errorf("failed to parse weather: %v", err)
+		}
+		o.SnapshotAt = snapshotAt.Format("2006-01-02 15:04:05")
+		res[o.Cell] = o
+	}
+
+	return res, rows.Err()
+}
+
+// GetSnapshotTimes return distinct snapshot times between from and to
+func (s *PostgresStore) GetSnapshotTimes(from string, to string) ([]string, error) {
+	rows, err := s.Db.Query("SELECT DISTINCT updated_at FROM stations WHERE updated_at >= $1 AND updated_at <= $2 ORDER BY updated_at", from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	var times []string
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		times = append(times, t.Format("2006-01-02 15:04:05"))
+	}
+
+	return times, rows.Err()
+}
+
+// GetStationPositions return kiosk id and position of every station in the snapshot
+func (s *PostgresStore) GetStationPositions(at string) ([]Properties, error) {
+	atFrom := fmt.Sprintf("%v.000", at)
+	atTo := fmt.Sprintf("%v.999", at)
+	rows, err := s.Db.Query("SELECT kiosk_id, latitude, longitude FROM stations WHERE updated_at >= $1 AND updated_at <= $2", atFrom, atTo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	var res []Properties
+	for rows.Next() {
+		p := Properties{}
+		if err := rows.Scan(&p.KioskId, &p.Latitude, &p.Longitude); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		res = append(res, p)
+	}
+
+	return res, rows.Err()
+}
+
+// GetWeatherCells return cells already having observation for the snapshot
+func (s *PostgresStore) GetWeatherCells(at string) (map[string]bool, error) {
+	rows, err := s.Db.Query("SELECT cell FROM weather_observations WHERE snapshot_at = $1", at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	cells := make(map[string]bool)
+	for rows.Next() {
+		var cell string
+		if err := rows.Scan(&cell); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		cells[cell] = true
+	}
+
+	return cells, rows.Err()
+}
+
+// GetWeatherObservations return every observation with snapshot between from and to
+func (s *PostgresStore) GetWeatherObservations(from string, to string) ([]WeatherObservation, error) {
+	rows, err := s.Db.Query("SELECT snapshot_at, cell, latitude, longitude, observed_at, data FROM weather_observations WHERE snapshot_at >= $1 AND snapshot_at <= $2", from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select query: %v", err)
+	}
+	defer rows.Close()
+
+	var res []WeatherObservation
+	for rows.Next() {
+		o := WeatherObservation{}
+		var snapshotAt time.Time
+		var data []byte
+		if err := rows.Scan(&snapshotAt, &o.Cell, &o.Latitude, &o.Longitude, &o.ObservedAt, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+
+		if o.Report, err = parseWeatherData(data); err != nil {
+			return nil, fmt.Errorf("failed to parse weather: %v", err)
+		}
+		o.SnapshotAt = snapshotAt.Format("2006-01-02 15:04:05")
+		res = append(res, o)
+	}
+
+	return res, rows.Err()
+}
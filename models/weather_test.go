@@ -0,0 +1,32 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWeatherDataLegacy(t *testing.T) {
+	// row captured before weather providers, open weather response in kelvin
+	legacy := `{"coord":{"lon":-75.16,"lat":39.95},"weather":[{"id":800,"main":"Clear","description":"clear sky","icon":"01d"}],"base":"stations","main":{"temp":285.65,"feels_like":284.5,"temp_min":284.15,"temp_max":287.15,"pressure":1020,"humidity":60},"visibility":10000,"wind":{"speed":3.6,"deg":250},"clouds":{"all":0},"dt":1731051011,"sys":{"country":"US","sunrise":1731065000,"sunset":1731101800},"timezone":-18000,"id":4560349,"name":"Philadelphia","cod":200}`
+	r, err := parseWeatherData([]byte(legacy))
+	assert.Nil(t, err)
+	assert.Equal(t, "openweathermap", r.Provider)
+	assert.InDelta(t, 12.5, r.Temp, 0.001)
+	assert.Equal(t, "Clear", r.Condition)
+	assert.Equal(t, int64(1731051011), r.ObservedAt.Unix())
+
+	w := r.ToWeather()
+	assert.InDelta(t, 285.65, w.Main.Temp, 0.001)
+	assert.InDelta(t, 284.15, w.Main.TempMin, 0.001)
+	assert.Equal(t, "01d", w.Weather[0].Icon)
+	assert.Equal(t, "Philadelphia", w.Name)
+	assert.Equal(t, int64(-18000), w.Timezone)
+
+	// report of a provider is read as is
+	r, err = parseWeatherData([]byte(`{"provider":"openmeteo","temp":12.5,"condition":"Rain"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 12.5, r.Temp)
+	assert.Nil(t, r.TempMin)
+	assert.InDelta(t, 285.65, r.ToWeather().Main.TempMax, 0.001)
+}
@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/waiwen1001/bike/config"
+)
+
+const instrumentation = "github.com/waiwen1001/bike"
+
+// Setup export spans to c.Endpoint and return the provider to shut down after the server stop.
+// Without endpoint spans are not recorded and the returned shutdown do nothing.
+func Setup(ctx context.Context, c config.Tracing) (func(context.Context) error, error) {
+	// traceparent of the caller is kept even when tracing is disabled here
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if c.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(c.Endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewProvider(c, sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// NewProvider return a provider sampling c.SampleRatio of new traces, tests pass an in-memory exporter with sdktrace.WithSyncer
+func NewProvider(c config.Tracing, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	attrs := []attribute.KeyValue{semconv.ServiceName(c.ServiceName)}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		attrs = append(attrs, semconv.ServiceVersion(info.Main.Version))
+	}
+
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	}, opts...)
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// Start a span of the global provider, a child of the span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// End record err on the span and end it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StoreSpan start the span of a storage method, the returned func end it with the method error
+func StoreSpan(ctx context.Context, method string) func(*error) {
+	_, span := Start(ctx, "Storage."+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperationName(method)))
+	return func(err *error) {
+		// not found is an answer of the query, not a failure
+		if *err != nil && strings.Contains((*err).Error(), "empty row") {
+			span.End()
+			return
+		}
+		End(span, *err)
+	}
+}
@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"encoding/base64"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,3 +26,28 @@ func ParseTime(at string) (time.Time, error) {
 
 	return time.Time{}, fmt.Errorf("unable to parse time: %s", at)
 }
+
+// EncodeCursor build an opaque pagination cursor from the list key (eg. snapshot time) and the last returned id
+func EncodeCursor(key string, id int64) string {
+	raw := fmt.Sprintf("%v|%d", key, id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(cursor string) (string, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+
+	i := strings.LastIndex(string(raw), "|")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+
+	id, err := strconv.ParseInt(string(raw[i+1:]), 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+
+	return string(raw[:i]), id, nil
+}
@@ -0,0 +1,61 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/waiwen1001/bike/models"
+)
+
+// Fixture return the same report for every coordinate, for tests and offline development
+type Fixture struct {
+	Report models.WeatherReport
+}
+
+// NewFixture load report from json file, empty path use a default clear weather report
+func NewFixture(path string) (*Fixture, error) {
+	f := &Fixture{Report: models.WeatherReport{
+		Temp:        15,
+		FeelsLike:   14,
+		Humidity:    60,
+		Pressure:    1015,
+		WindSpeed:   3,
+		Clouds:      10,
+		Visibility:  10000,
+		Condition:   "Clear",
+		Description: "clear sky",
+	}}
+
+	if path == "" {
+		return f, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read weather fixture: %v", err)
+	}
+
+	if err := json.Unmarshal(b, &f.Report); err != nil {
+		return nil, fmt.Errorf("invalid weather fixture: %v", err)
+	}
+
+	return f, nil
+}
+
+func (f *Fixture) Name() string {
+	return "fixture"
+}
+
+func (f *Fixture) Current(ctx context.Context, latitude float64, longitude float64) (models.WeatherReport, error) {
+	r := f.Report
+	r.Provider = f.Name()
+	r.Latitude = latitude
+	r.Longitude = longitude
+	if r.ObservedAt.IsZero() {
+		r.ObservedAt = time.Now().UTC().Truncate(time.Minute)
+	}
+	return r, nil
+}
@@ -0,0 +1,185 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/models"
+)
+
+// HistoricalProvider return weather of a coordinate at a past hour
+type HistoricalProvider interface {
+	Provider
+	Historical(ctx context.Context, latitude float64, longitude float64, at time.Time) (models.WeatherReport, error)
+}
+
+// NewHistoricalProvider select HistoryProvider, default to Provider
+func NewHistoricalProvider(c config.Weather) (HistoricalProvider, error) {
+	name := c.HistoryProvider
+	if name == "" {
+		name = c.Provider
+	}
+
+	p, err := NewProvider(name, c)
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := p.(HistoricalProvider)
+	if !ok {
+		return nil, fmt.Errorf("weather provider %s has no historical data", p.Name())
+	}
+	return h, nil
+}
+
+// Historical use one call timemachine api, require a subscription with history access
+func (o *OpenWeatherMap) Historical(ctx context.Context, latitude float64, longitude float64, at time.Time) (models.WeatherReport, error) {
+	baseUrl := o.BaseUrl
+	if baseUrl == "" {
+		baseUrl = "https://api.openweathermap.org"
+	}
+
+	apiUrl := fmt.Sprintf("%v/data/3.0/onecall/timemachine?lat=%f&lon=%f&dt=%d&units=metric&appid=%v", baseUrl, latitude, longitude, at.Unix(), o.ApiKey)
+	resp, err := getJSON(ctx, apiUrl)
+	if err != nil {
+		return models.WeatherReport{}, err
+	}
+
+	defer resp.Body.Close()
+	var data struct {
+		Data []struct {
+			Dt         int64                `json:"dt"`
+			Temp       float64              `json:"temp"`
+			FeelsLike  float64              `json:"feels_like"`
+			Pressure   float64              `json:"pressure"`
+			Humidity   float64              `json:"humidity"`
+			Clouds     int64                `json:"clouds"`
+			Visibility int64                `json:"visibility"`
+			WindSpeed  float64              `json:"wind_speed"`
+			WindDeg    int64                `json:"wind_deg"`
+			WindGust   float64              `json:"wind_gust"`
+			Weather    []models.WeatherInfo `json:"weather"`
+			Rain       struct {
+				OneHour float64 `json:"1h"`
+			} `json:"rain"`
+			Snow struct {
+				OneHour float64 `json:"1h"`
+			} `json:"snow"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return models.WeatherReport{}, fmt.Errorf("parsing open weather history response err: %v", err)
+	}
+
+	if len(data.Data) == 0 {
+		return models.WeatherReport{}, fmt.Errorf("open weather history has no data at %v", at)
+	}
+
+	d := data.Data[0]
+	report := models.WeatherReport{
+		Provider:      o.Name(),
+		ObservedAt:    time.Unix(d.Dt, 0).UTC(),
+		Latitude:      latitude,
+		Longitude:     longitude,
+		Temp:          d.Temp,
+		FeelsLike:     d.FeelsLike,
+		Humidity:      d.Humidity,
+		Pressure:      d.Pressure,
+		WindSpeed:     d.WindSpeed,
+		WindDeg:       d.WindDeg,
+		WindGust:      d.WindGust,
+		Clouds:        d.Clouds,
+		Precipitation: d.Rain.OneHour + d.Snow.OneHour,
+		Visibility:    d.Visibility,
+	}
+	if len(d.Weather) > 0 {
+		report.Condition = d.Weather[0].Main
+		report.Description = d.Weather[0].Description
+	}
+
+	return report, nil
+}
+
+type openMeteoHourly struct {
+	Time                []string  `json:"time"`
+	Temperature2m       []float64 `json:"temperature_2m"`
+	RelativeHumidity2m  []float64 `json:"relative_humidity_2m"`
+	ApparentTemperature []float64 `json:"apparent_temperature"`
+	Precipitation       []float64 `json:"precipitation"`
+	WeatherCode         []int64   `json:"weather_code"`
+	CloudCover          []int64   `json:"cloud_cover"`
+	PressureMsl         []float64 `json:"pressure_msl"`
+	WindSpeed10m        []float64 `json:"wind_speed_10m"`
+	WindDirection10m    []int64   `json:"wind_direction_10m"`
+	WindGusts10m        []float64 `json:"wind_gusts_10m"`
+}
+
+// Historical use the archive api, see https://open-meteo.com/en/docs/historical-weather-api
+func (o *OpenMeteo) Historical(ctx context.Context, latitude float64, longitude float64, at time.Time) (models.WeatherReport, error) {
+	baseUrl := o.ArchiveUrl
+	if baseUrl == "" {
+		baseUrl = "https://archive-api.open-meteo.com"
+	}
+
+	at = at.UTC()
+	day := at.Format("2006-01-02")
+	apiUrl := fmt.Sprintf("%v/v1/archive?latitude=%f&longitude=%f&start_date=%v&end_date=%v&hourly=%v&wind_speed_unit=ms&timezone=GMT", baseUrl, latitude, longitude, day, day, openMeteoFields)
+	resp, err := getJSON(ctx, apiUrl)
+	if err != nil {
+		return models.WeatherReport{}, err
+	}
+
+	defer resp.Body.Close()
+	var data struct {
+		Hourly openMeteoHourly `json:"hourly"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return models.WeatherReport{}, fmt.Errorf("parsing open meteo archive response err: %v", err)
+	}
+
+	h := data.Hourly
+	hour := at.Truncate(time.Hour).Format("2006-01-02T15:04")
+	for i, t := range h.Time {
+		if t != hour || i >= len(h.Temperature2m) || i >= len(h.WeatherCode) {
+			continue
+		}
+
+		c := openMeteoCurrent{Time: t, Temperature2m: h.Temperature2m[i], WeatherCode: h.WeatherCode[i]}
+		if i < len(h.RelativeHumidity2m) {
+			c.RelativeHumidity2m = h.RelativeHumidity2m[i]
+		}
+		if i < len(h.ApparentTemperature) {
+			c.ApparentTemperature = h.ApparentTemperature[i]
+		}
+		if i < len(h.Precipitation) {
+			c.Precipitation = h.Precipitation[i]
+		}
+		if i < len(h.CloudCover) {
+			c.CloudCover = h.CloudCover[i]
+		}
+		if i < len(h.PressureMsl) {
+			c.PressureMsl = h.PressureMsl[i]
+		}
+		if i < len(h.WindSpeed10m) {
+			c.WindSpeed10m = h.WindSpeed10m[i]
+		}
+		if i < len(h.WindDirection10m) {
+			c.WindDirection10m = h.WindDirection10m[i]
+		}
+		if i < len(h.WindGusts10m) {
+			c.WindGusts10m = h.WindGusts10m[i]
+		}
+		return o.report(c, latitude, longitude), nil
+	}
+
+	return models.WeatherReport{}, fmt.Errorf("open meteo archive has no data at %v", hour)
+}
+
+func (f *Fixture) Historical(ctx context.Context, latitude float64, longitude float64, at time.Time) (models.WeatherReport, error) {
+	r, err := f.Current(ctx, latitude, longitude)
+	r.ObservedAt = at.UTC().Truncate(time.Hour)
+	return r, err
+}
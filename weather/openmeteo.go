@@ -0,0 +1,106 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/waiwen1001/bike/models"
+)
+
+const openMeteoFields = "temperature_2m,relative_humidity_2m,apparent_temperature,precipitation,weather_code,cloud_cover,pressure_msl,wind_speed_10m,wind_direction_10m,wind_gusts_10m"
+
+// OpenMeteo need no api key, see https://open-meteo.com/en/docs
+type OpenMeteo struct {
+	// BaseUrl default to api.open-meteo.com, ArchiveUrl default to archive-api.open-meteo.com, override for testing
+	BaseUrl    string
+	ArchiveUrl string
+}
+
+type openMeteoCurrent struct {
+	Time                string  `json:"time"`
+	Temperature2m       float64 `json:"temperature_2m"`
+	RelativeHumidity2m  float64 `json:"relative_humidity_2m"`
+	ApparentTemperature float64 `json:"apparent_temperature"`
+	Precipitation       float64 `json:"precipitation"`
+	WeatherCode         int64   `json:"weather_code"`
+	CloudCover          int64   `json:"cloud_cover"`
+	PressureMsl         float64 `json:"pressure_msl"`
+	WindSpeed10m        float64 `json:"wind_speed_10m"`
+	WindDirection10m    int64   `json:"wind_direction_10m"`
+	WindGusts10m        float64 `json:"wind_gusts_10m"`
+}
+
+type openMeteoResponse struct {
+	Current openMeteoCurrent `json:"current"`
+}
+
+func (o *OpenMeteo) Name() string {
+	return "openmeteo"
+}
+
+func (o *OpenMeteo) Current(ctx context.Context, latitude float64, longitude float64) (models.WeatherReport, error) {
+	baseUrl := o.BaseUrl
+	if baseUrl == "" {
+		baseUrl = "https://api.open-meteo.com"
+	}
+
+	apiUrl := fmt.Sprintf("%v/v1/forecast?latitude=%f&longitude=%f&current=%v&wind_speed_unit=ms&timezone=GMT", baseUrl, latitude, longitude, openMeteoFields)
+	resp, err := getJSON(ctx, apiUrl)
+	if err != nil {
+		return models.WeatherReport{}, err
+	}
+
+	defer resp.Body.Close()
+	var data openMeteoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return models.WeatherReport{}, fmt.Errorf("parsing open meteo response err: %v", err)
+	}
+
+	return o.report(data.Current, latitude, longitude), nil
+}
+
+func (o *OpenMeteo) report(c openMeteoCurrent, latitude float64, longitude float64) models.WeatherReport {
+	observedAt, _ := time.Parse("2006-01-02T15:04", c.Time)
+	condition, description := wmoCondition(c.WeatherCode)
+
+	return models.WeatherReport{
+		Provider:      o.Name(),
+		ObservedAt:    observedAt,
+		Latitude:      latitude,
+		Longitude:     longitude,
+		Temp:          c.Temperature2m,
+		FeelsLike:     c.ApparentTemperature,
+		Humidity:      c.RelativeHumidity2m,
+		Pressure:      c.PressureMsl,
+		WindSpeed:     c.WindSpeed10m,
+		WindDeg:       c.WindDirection10m,
+		WindGust:      c.WindGusts10m,
+		Clouds:        c.CloudCover,
+		Precipitation: c.Precipitation,
+		Condition:     condition,
+		Description:   description,
+	}
+}
+
+// wmoCondition map WMO weather code to open weather main group so condition is comparable across providers
+func wmoCondition(code int64) (string, string) {
+	switch {
+	case code == 0:
+		return "Clear", "clear sky"
+	case code <= 3:
+		return "Clouds", "partly cloudy"
+	case code == 45 || code == 48:
+		return "Fog", "fog"
+	case code >= 51 && code <= 57:
+		return "Drizzle", "drizzle"
+	case (code >= 61 && code <= 67) || (code >= 80 && code <= 82):
+		return "Rain", "rain"
+	case (code >= 71 && code <= 77) || code == 85 || code == 86:
+		return "Snow", "snow"
+	case code >= 95:
+		return "Thunderstorm", "thunderstorm"
+	}
+	return "Unknown", fmt.Sprintf("weather code %d", code)
+}
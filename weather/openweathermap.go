@@ -0,0 +1,57 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/waiwen1001/bike/models"
+)
+
+type OpenWeatherMap struct {
+	ApiKey string
+	// BaseUrl default to api.openweathermap.org, override for testing
+	BaseUrl string
+}
+
+type owmResponse struct {
+	models.Weather
+	Rain struct {
+		OneHour float64 `json:"1h"`
+	} `json:"rain"`
+	Snow struct {
+		OneHour float64 `json:"1h"`
+	} `json:"snow"`
+}
+
+func (o *OpenWeatherMap) Name() string {
+	return "openweathermap"
+}
+
+func (o *OpenWeatherMap) Current(ctx context.Context, latitude float64, longitude float64) (models.WeatherReport, error) {
+	baseUrl := o.BaseUrl
+	if baseUrl == "" {
+		baseUrl = "https://api.openweathermap.org"
+	}
+
+	apiUrl := fmt.Sprintf("%v/data/2.5/weather?lat=%f&lon=%f&units=metric&appid=%v", baseUrl, latitude, longitude, o.ApiKey)
+	resp, err := getJSON(ctx, apiUrl)
+	if err != nil {
+		return models.WeatherReport{}, err
+	}
+
+	defer resp.Body.Close()
+	var data owmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return models.WeatherReport{}, fmt.Errorf("parsing open weather response err: %v", err)
+	}
+
+	// units=metric, temperatures are already celsius
+	report := models.WeatherReportFromOWM(data.Weather, 0)
+	report.Provider = o.Name()
+	report.Latitude = latitude
+	report.Longitude = longitude
+	report.Precipitation = data.Rain.OneHour + data.Snow.OneHour
+
+	return report, nil
+}
@@ -0,0 +1,52 @@
+package weather
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/waiwen1001/bike/config"
+	"github.com/waiwen1001/bike/models"
+)
+
+// if more than 10 seconds go timeout
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Provider return current weather of a coordinate in normalized model
+type Provider interface {
+	Name() string
+	Current(ctx context.Context, latitude float64, longitude float64) (models.WeatherReport, error)
+}
+
+// NewProvider select provider by name: openweathermap (default), openmeteo or fixture
+func NewProvider(name string, c config.Weather) (Provider, error) {
+	switch name {
+	case "", "openweathermap":
+		return &OpenWeatherMap{ApiKey: c.OpenWeatherKey}, nil
+	case "openmeteo":
+		return &OpenMeteo{}, nil
+	case "fixture":
+		return NewFixture(c.FixtureFile)
+	}
+	return nil, fmt.Errorf("unknown weather provider: %s", name)
+}
+
+func getJSON(ctx context.Context, apiUrl string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("weather API responded %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
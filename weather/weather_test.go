@@ -0,0 +1,92 @@
+package weather
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/waiwen1001/bike/config"
+)
+
+func TestOpenWeatherMapCurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "metric", r.URL.Query().Get("units"))
+		w.Write([]byte(`{"weather":[{"id":500,"main":"Rain","description":"light rain","icon":"10d"}],"main":{"temp":12.5,"temp_min":11,"temp_max":14,"humidity":80},"wind":{"speed":4.1},"rain":{"1h":0.6},"dt":1731051011,"sys":{"country":"US","sunrise":1731065000,"sunset":1731101800},"timezone":-18000,"id":4560349,"name":"Philadelphia"}`))
+	}))
+	defer ts.Close()
+
+	p := &OpenWeatherMap{ApiKey: "key", BaseUrl: ts.URL}
+	r, err := p.Current(context.Background(), 39.95, -75.16)
+	assert.Nil(t, err)
+	assert.Equal(t, "Rain", r.Condition)
+	assert.Equal(t, 12.5, r.Temp)
+	assert.Equal(t, 0.6, r.Precipitation)
+	assert.Equal(t, int64(1731051011), r.ObservedAt.Unix())
+
+	// api response keep the open weather fields
+	w := r.ToWeather()
+	assert.Equal(t, int64(500), w.Weather[0].Id)
+	assert.Equal(t, "10d", w.Weather[0].Icon)
+	assert.InDelta(t, 284.15, w.Main.TempMin, 0.001)
+	assert.InDelta(t, 287.15, w.Main.TempMax, 0.001)
+	assert.Equal(t, "Philadelphia", w.Name)
+	assert.Equal(t, int64(4560349), w.Id)
+	assert.Equal(t, "US", w.Sys.Country)
+	assert.Equal(t, int64(1731101800), w.Sys.Sunset)
+	assert.Equal(t, int64(-18000), w.Timezone)
+}
+
+func TestOpenMeteoCurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"current":{"time":"2024-11-08T07:30","temperature_2m":9.8,"precipitation":1.2,"weather_code":63,"wind_speed_10m":5.5}}`))
+	}))
+	defer ts.Close()
+
+	p := &OpenMeteo{BaseUrl: ts.URL}
+	r, err := p.Current(context.Background(), 39.95, -75.16)
+	assert.Nil(t, err)
+	assert.Equal(t, "Rain", r.Condition)
+	assert.Equal(t, 9.8, r.Temp)
+	assert.Equal(t, "2024-11-08 07:30:00", r.ObservedAt.Format("2006-01-02 15:04:05"))
+}
+
+func TestNewProvider(t *testing.T) {
+	p, err := NewProvider("fixture", config.Weather{})
+	assert.Nil(t, err)
+
+	r, err := p.Current(context.Background(), 39.95, -75.16)
+	assert.Nil(t, err)
+	assert.Equal(t, "fixture", r.Provider)
+	assert.Equal(t, 39.95, r.Latitude)
+
+	_, err = NewProvider("darksky", config.Weather{})
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	p := &OpenWeatherMap{BaseUrl: ts.URL}
+	_, err := p.Current(context.Background(), 39.95, -75.16)
+	assert.NotNil(t, err)
+}
+
+func TestOpenMeteoHistorical(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2024-11-08", r.URL.Query().Get("start_date"))
+		w.Write([]byte(`{"hourly":{"time":["2024-11-08T06:00","2024-11-08T07:00"],"temperature_2m":[8.1,9.3],"weather_code":[0,61]}}`))
+	}))
+	defer ts.Close()
+
+	p := &OpenMeteo{ArchiveUrl: ts.URL}
+	r, err := p.Historical(context.Background(), 39.95, -75.16, time.Date(2024, 11, 8, 7, 30, 11, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, 9.3, r.Temp)
+	assert.Equal(t, "Rain", r.Condition)
+}